@@ -11,6 +11,9 @@ import (
 var (
 	name        string
 	endpoint    string
+	grpcaddr    string
+	httpaddr    string
+	rack        string
 	etcdcluster string
 	help        bool
 )
@@ -18,6 +21,9 @@ var (
 func init() {
 	flag.StringVar(&name, "name", "", "local broker name for cluster. If not set, then using uuid.")
 	flag.StringVar(&endpoint, "listen", "127.0.0.1:7001", "listen address for broker server.")
+	flag.StringVar(&grpcaddr, "grpc", "", "listen address for broker grpc service. If not set, then disable.")
+	flag.StringVar(&httpaddr, "http", "", "listen address for broker http service. If not set, then disable.")
+	flag.StringVar(&rack, "rack", "", "rack or zone of the broker. replicas of a partition are placed on different racks.")
 	flag.StringVar(&etcdcluster, "etcd", "127.0.0.1:2379", "etcd server cluster address list. such as \"ip1:port,ip2:port...\".")
 
 	flag.BoolVar(&help, "help", false, "this help.")
@@ -40,6 +46,10 @@ func main() {
 	etcdaddr := strings.Split(etcdcluster, ",")
 	log.Println("connect etcd cluster :", etcdaddr)
 
+	broker.BrokerGrpcEndpointSet(grpcaddr)
+	broker.BrokerHttpEndpointSet(httpaddr)
+	broker.BrokerRackSet(rack)
+
 	err := broker.BrokerStart(name, endpoint, etcdaddr)
 	if err != nil {
 		log.Println(err.Error())
@@ -2,20 +2,32 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/lixiangyun/go-state/broker"
 )
 
 var (
 	consumer    string
+	clustername string
+	topics      string
+	group       string
+	strategy    string
 	etcdcluster string
 	help        bool
 )
 
 func init() {
 	flag.StringVar(&consumer, "name", "", "local consumer name. If not set, then using uuid.")
+	flag.StringVar(&clustername, "cluster", "default", "the broker cluster name to consume.")
+	flag.StringVar(&topics, "topic", "", "topic list to subscribe. such as \"topic1,topic2...\".")
+	flag.StringVar(&group, "group", "", "consumer group to join. If not set, then consume all partitions alone.")
+	flag.StringVar(&strategy, "strategy", broker.ASSIGN_RANGE, "partition assign strategy of group. \"range\" or \"roundrobin\".")
 	flag.StringVar(&etcdcluster, "etcd", "127.0.0.1:2379", "etcd server cluster address list. such as \"ip1:port,ip2:port...\".")
 
 	flag.BoolVar(&help, "help", false, "this help.")
@@ -24,11 +36,13 @@ func init() {
 func main() {
 	flag.Parse()
 
-	if help {
+	if help || topics == "" {
 		flag.Usage()
 		return
 	}
 
+	broker.BrokerClusterNameSet(clustername)
+
 	if consumer == "" {
 		consumer = broker.UUID(broker.UUID64)
 	}
@@ -37,9 +51,51 @@ func main() {
 	etcdaddr := strings.Split(etcdcluster, ",")
 	log.Println("connect etcd cluster :", etcdaddr)
 
-	err := broker.BrokerStart(name, endpoint, etcdaddr)
+	c, err := broker.NewConsumer(consumer, etcdaddr)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer c.Close()
+
+	if group != "" {
+		err = c.JoinGroup(group, strategy, strings.Split(topics, ",")...)
+	} else {
+		err = c.Subscribe(strings.Split(topics, ",")...)
+	}
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
+
+	exit := make(chan os.Signal, 1)
+	signal.Notify(exit, os.Interrupt)
+
+	for {
+		select {
+		case <-exit:
+			log.Println("consumer exit!", consumer)
+			return
+		default:
+		}
+
+		messages, err := c.Poll(0)
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		for _, v := range messages {
+			fmt.Printf("[%s:%d] %s\r\n", v.Topic, v.Offset, string(v.Body))
+		}
+
+		if len(messages) > 0 {
+			err = c.Commit()
+			if err != nil {
+				log.Println(err.Error())
+			}
+			continue
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
 }
@@ -1,23 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"io"
 	"log"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/lixiangyun/go-state/broker"
 )
 
 var (
-	name        string
-	endpoint    string
+	clustername string
+	topic       string
+	filename    string
+	keysep      string
+	acks        string
+	timeout     int
 	etcdcluster string
 	help        bool
 )
 
 func init() {
-	flag.StringVar(&name, "name", "", "local broker name for cluster. If not set, then using uuid.")
-	flag.StringVar(&endpoint, "listen", "127.0.0.1:7001", "listen address for broker server.")
+	flag.StringVar(&clustername, "cluster", "default", "the broker cluster name to produce.")
+	flag.StringVar(&topic, "topic", "", "topic name to produce message.")
+	flag.StringVar(&filename, "file", "", "message file, one message per line. If not set, then read from stdin.")
+	flag.StringVar(&keysep, "keysep", "", "split each line at the first separator into message key and body. messages of one key go to one partition.")
+	flag.StringVar(&acks, "acks", "1", "produce acknowledgement. \"0\", \"1\" or \"all\".")
+	flag.IntVar(&timeout, "timeout", 5000, "timeout in millisecond to wait all replicas when acks is \"all\".")
 	flag.StringVar(&etcdcluster, "etcd", "127.0.0.1:2379", "etcd server cluster address list. such as \"ip1:port,ip2:port...\".")
 
 	flag.BoolVar(&help, "help", false, "this help.")
@@ -27,22 +39,71 @@ func main() {
 
 	flag.Parse()
 
-	if help {
+	if help || topic == "" {
 		flag.Usage()
 		return
 	}
 
-	if name == "" {
-		name = broker.UUID(broker.UUID64)
+	broker.BrokerClusterNameSet(clustername)
+
+	acklevel, err := broker.ParseAcks(acks)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	var input io.Reader = os.Stdin
+	if filename != "" {
+		file, err := os.Open(filename)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		defer file.Close()
+		input = file
 	}
-	log.Println("broker name is", name)
 
 	etcdaddr := strings.Split(etcdcluster, ",")
 	log.Println("connect etcd cluster :", etcdaddr)
 
-	err := broker.BrokerStart(name, endpoint, etcdaddr)
+	producer, err := broker.NewProducer(etcdaddr)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
+	defer producer.Close()
+
+	producer.Acks = acklevel
+	producer.Timeout = time.Duration(timeout) * time.Millisecond
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), broker.FRAME_MAXSIZE)
+
+	var count int
+	var offset uint64
+
+	for scanner.Scan() {
+		var key []byte
+		line := scanner.Text()
+		if keysep != "" {
+			if idx := strings.Index(line, keysep); idx != -1 {
+				key = []byte(line[:idx])
+				line = line[idx+len(keysep):]
+			}
+		}
+
+		offset, err = producer.SendKey(topic, key, []byte(line))
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		count++
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	log.Printf("produce %d message to topic [%s], last offset %d\r\n", count, topic, offset)
 }
@@ -38,10 +38,17 @@ func keepalive(ttl int, lease clientv3.LeaseID) {
 	}
 }
 
+var brokerRack string
+
+/* broker 所在的机架或者可用区, 控制器把同一个分区的副本分散到不同的机架 */
+func BrokerRackSet(rack string) {
+	brokerRack = rack
+}
+
 func BrokerRegister(name string, endpoint string) error {
 
 	key := KEY_BROKER + name
-	brk := &DataBroker{Broker: name, Addr: endpoint}
+	brk := &DataBroker{Broker: name, Addr: endpoint, Grpc: grpcEndpoint, Http: httpEndpoint, Rack: brokerRack}
 
 	value, err := json.Marshal(brk)
 	if err != nil {
@@ -68,6 +75,11 @@ func BrokerRegister(name string, endpoint string) error {
 	if resp.Succeeded {
 		go keepalive(defaultTTL, rasp.ID)
 		log.Println("broker [" + name + "] register success!")
+
+		err = BrokerDecommissionDelete(gEtcd, name)
+		if err != nil {
+			log.Println("broker decommission clear failed!", err.Error())
+		}
 		return nil
 	}
 
@@ -79,6 +91,8 @@ type PartitionManager struct {
 	BrokerName   string
 	PartitionCfg map[string]DataPartition
 	PartitionSeg map[string]*Partition
+	fetchers     map[string]*replicaFetcher
+	trackers     map[string]*isrTracker
 	watchctx     context.Context
 	cancel       context.CancelFunc
 }
@@ -88,6 +102,8 @@ var gPartitionMng PartitionManager
 func init() {
 	gPartitionMng.PartitionCfg = make(map[string]DataPartition, 0)
 	gPartitionMng.PartitionSeg = make(map[string]*Partition, 0)
+	gPartitionMng.fetchers = make(map[string]*replicaFetcher, 0)
+	gPartitionMng.trackers = make(map[string]*isrTracker, 0)
 	gPartitionMng.watchctx, gPartitionMng.cancel = context.WithCancel(context.Background())
 }
 
@@ -104,70 +120,379 @@ func (p *PartitionManager) Add(partition DataPartition) {
 		p.PartitionCfg[partition.PartitionID] = partition
 	}
 
-	for _, one := range p.PartitionCfg {
+	if stringsHas(replicaBrokers(&partition), p.BrokerName) == false {
+		p.remove(partition.PartitionID)
+	}
 
-		_, exist := p.PartitionSeg[one.PartitionID]
-		if exist {
-			continue
-		}
+	for _, one := range p.PartitionCfg {
 
 		for _, rep := range one.Replicas {
-			if rep.Broker == p.BrokerName {
-				partitionSeg := NewPartition(one.PartitionID, rep.Role)
-				if partitionSeg != nil {
-					log.Println("add partition segment success!", partitionSeg)
-					p.PartitionSeg[one.PartitionID] = partitionSeg
+			if rep.Broker != p.BrokerName {
+				continue
+			}
+
+			partitionSeg, exist := p.PartitionSeg[one.PartitionID]
+			if exist == false {
+				partitionSeg = NewPartition(one.PartitionID, rep.Role)
+				if partitionSeg == nil {
+					continue
+				}
+				if policy, b := topicSyncPolicy(one.Topic); b {
+					partitionSeg.SetSyncPolicy(policy)
 				}
+				log.Println("add partition segment success!", partitionSeg)
+				p.PartitionSeg[one.PartitionID] = partitionSeg
+			} else if partitionSeg.GetStatus() != rep.Role {
+				log.Println("partition role change!", one.PartitionID, partitionSeg.GetStatus(), rep.Role)
+				partitionSeg.UpdateStatus(rep.Role)
 			}
+
+			p.syncReplica(partitionSeg, one)
 		}
 	}
 }
 
-func (p *PartitionManager) Put(partitionId string, message []byte) (uint64, error) {
+/* 新建分区时读取 topic 的落盘策略, 之后的修改由清理协程同步 */
+func topicSyncPolicy(name string) (SyncPolicy, bool) {
+	if name == "" || gEtcd == nil {
+		return SYNC_DEFAULT, false
+	}
+
+	topic, err := BrokerTopicFind(gEtcd, name)
+	if err != nil {
+		return SYNC_DEFAULT, false
+	}
+
+	policy, err := topic.SyncPolicy()
+	if err != nil {
+		log.Println(err.Error(), name)
+		return SYNC_DEFAULT, false
+	}
+
+	return policy, true
+}
+
+/* topic 删除后分区记录随之删除, 删除本地的分区数据 */
+func (p *PartitionManager) Delete(partitionId string) {
 	p.Lock()
 	defer p.Unlock()
 
+	log.Println("partition configure delete: ", partitionId)
+
+	delete(p.PartitionCfg, partitionId)
+	p.remove(partitionId)
+}
+
+/* 副本迁移到其他 broker 后, 停止复制并删除本地的分区目录 */
+func (p *PartitionManager) remove(partitionId string) {
+	partseg, exist := p.PartitionSeg[partitionId]
+	if exist == false {
+		return
+	}
+
+	if fetcher, b := p.fetchers[partitionId]; b {
+		fetcher.stop()
+		delete(p.fetchers, partitionId)
+	}
+	if tracker, b := p.trackers[partitionId]; b {
+		tracker.stop()
+		delete(p.trackers, partitionId)
+	}
+
+	delete(p.PartitionSeg, partitionId)
+	partseg.Delete()
+
+	log.Println("partition replica remove!", partitionId)
+}
+
+/* 从副本启动复制协程, 主副本跟踪同步副本集合, 角色变化后停止原来的协程 */
+func (p *PartitionManager) syncReplica(part *Partition, cfg DataPartition) {
+	fetcher, exist := p.fetchers[part.ID]
+
+	if part.GetStatus() == PART_S_FOLLOW {
+		if exist == false {
+			p.fetchers[part.ID] = newReplicaFetcher(part)
+		}
+	} else if exist {
+		fetcher.stop()
+		delete(p.fetchers, part.ID)
+	}
+
+	tracker, exist := p.trackers[part.ID]
+
+	if part.GetStatus() == PART_S_PRIMARY {
+		if exist == false {
+			p.trackers[part.ID] = newIsrTracker(part, cfg)
+		} else {
+			tracker.update(cfg)
+		}
+	} else if exist {
+		tracker.stop()
+		delete(p.trackers, part.ID)
+	}
+}
+
+/* 返回分区主副本所在的 broker 名称 */
+func (p *PartitionManager) Primary(partitionId string) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, rep := range p.PartitionCfg[partitionId].Replicas {
+		if rep.Role == PART_S_PRIMARY {
+			return rep.Broker
+		}
+	}
+	return ""
+}
+
+func (p *PartitionManager) Exist(partitionId string) bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	_, exist := p.PartitionSeg[partitionId]
+	return exist
+}
+
+func (p *PartitionManager) Put(partitionId string, message []byte) (uint64, error) {
+	return p.PutMessage(partitionId, &Message{Body: message})
+}
+
+func (p *PartitionManager) PutMessage(partitionId string, message *Message) (uint64, error) {
+	_, last, err := p.PutMessages(partitionId, []Message{*message})
+	return last, err
+}
+
+func (p *PartitionManager) PutBatch(partitionId string, messages [][]byte) (uint64, uint64, error) {
+	list := make([]Message, len(messages))
+	for i, v := range messages {
+		list[i].Body = v
+	}
+	return p.PutMessages(partitionId, list)
+}
+
+/*
+ * 批量写入主副本, 返回第一个和最后一个偏移.
+ * 只在查找分区时持有管理器的锁, 写入和落盘等待期间不阻塞其他分区的配置变更.
+ */
+func (p *PartitionManager) PutMessages(partitionId string, messages []Message) (uint64, uint64, error) {
+	p.RLock()
 	partseg, exist := p.PartitionSeg[partitionId]
+	p.RUnlock()
+
 	if exist == false {
 		log.Println("partition is not exist!", partitionId)
-		return INVALID_OFFSET, errors.New("partition is not exist!")
+		return INVALID_OFFSET, INVALID_OFFSET, ErrUnknownPartition
 	}
 
-	return partseg.Write(message), nil
+	return partseg.writePrimary(messages)
+}
+
+/* acks=all 时等待同步副本集合都写入 offset, 即高水位到达 offset */
+func (p *PartitionManager) WaitAcks(partitionId string, offset uint64, acks ACKS, timeout time.Duration) error {
+	if acks != ACKS_ALL {
+		return nil
+	}
+
+	p.RLock()
+	partseg, exist := p.PartitionSeg[partitionId]
+	p.RUnlock()
+
+	if exist == false {
+		return ErrUnknownPartition
+	}
+
+	if partseg.WaitHighWatermark(offset, timeout) == false {
+		return ErrAckTimeout
+	}
+	return nil
 }
 
 func (p *PartitionManager) Get(partitionId string, offset uint64) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
+	p.RLock()
+	defer p.RUnlock()
 
 	partseg, exist := p.PartitionSeg[partitionId]
 	if exist == false {
 		log.Println("partition is not exist!", partitionId)
-		return nil, errors.New("partition is not exist!")
+		return nil, ErrUnknownPartition
+	}
+
+	if offset < partseg.StartOffset() {
+		return nil, ErrOffsetOutOfRange
+	}
+
+	body := partseg.Read(offset)
+	if body == nil {
+		return nil, ErrNoMessage
 	}
 
-	return partseg.Read(offset), nil
+	return body, nil
 }
 
-func BrokerPartitionInit(etcdconn *EtcdConn) {
+/* 消费者只能读到高水位以内的消息, 同时返回高水位和日志起始偏移, 偏移已经被清理时也返回 */
+func (p *PartitionManager) Fetch(partitionId string, offset uint64, maxcount int, maxbytes int) ([][]byte, uint64, uint64, error) {
+	p.RLock()
+	defer p.RUnlock()
 
-	partitionChan := BrokerPartitionWatch(gPartitionMng.watchctx, etcdconn)
+	partseg, exist := p.PartitionSeg[partitionId]
+	if exist == false {
+		log.Println("partition is not exist!", partitionId)
+		return nil, 0, 0, ErrUnknownPartition
+	}
 
-	go func() {
-		for {
-			partition := <-partitionChan
-			gPartitionMng.Add(partition)
+	hw, start := partseg.HighWatermark(), partseg.StartOffset()
+	if offset < start {
+		return nil, hw, start, ErrOffsetOutOfRange
+	}
+
+	return partseg.ReadRange(offset, maxcount, maxbytes), hw, start, nil
+}
+
+/* 消费者持续顺序读取时使用, 只读取高水位以内的消息 */
+func (p *PartitionManager) NewIterator(partitionId string, offset uint64) (*Iterator, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	partseg, exist := p.PartitionSeg[partitionId]
+	if exist == false {
+		log.Println("partition is not exist!", partitionId)
+		return nil, ErrUnknownPartition
+	}
+
+	if offset < partseg.StartOffset() {
+		return nil, ErrOffsetOutOfRange
+	}
+
+	return partseg.NewIterator(offset, true), nil
+}
+
+/* 日志起始偏移, 从副本落后于起始偏移时需要从这里重新复制 */
+func (p *PartitionManager) StartOffset(partitionId string) (uint64, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	partseg, exist := p.PartitionSeg[partitionId]
+	if exist == false {
+		return 0, ErrUnknownPartition
+	}
+
+	return partseg.StartOffset(), nil
+}
+
+/* 从副本复制不受高水位限制, 同时更新从副本的复制进度并返回高水位 */
+func (p *PartitionManager) ReplicaFetch(partitionId string, replica string, offset uint64, maxcount int, maxbytes int) ([][]byte, uint64, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	partseg, exist := p.PartitionSeg[partitionId]
+	if exist == false {
+		log.Println("partition is not exist!", partitionId)
+		return nil, 0, ErrUnknownPartition
+	}
+
+	tracker, exist := p.trackers[partitionId]
+	if exist == false {
+		return nil, 0, ErrNotPrimary
+	}
+	/* 只有分区的从副本可以读到高水位之后的消息 */
+	err := tracker.fetched(replica, offsetBefore(offset))
+	if err != nil {
+		log.Println("replica fetch is refused!", partitionId, replica)
+		return nil, 0, err
+	}
+
+	records := partseg.NewIterator(offset, false).Range(maxcount, maxbytes)
+
+	return records, partseg.HighWatermark(), nil
+}
+
+/* 监听中断后重新监听, 并按 etcd 中的分区列表重新加载, 补上中断期间的变化 */
+func (p *PartitionManager) watch(etcdconn *EtcdConn, partitionChan <-chan PartitionEvent) {
+	for {
+		for event := range partitionChan {
+			if event.Deleted {
+				p.Delete(event.PartitionID)
+			} else {
+				p.Add(event.DataPartition)
+			}
+		}
+
+		select {
+		case <-p.watchctx.Done():
+			return
+		case <-time.After(time.Second):
 		}
-	}()
 
-	partitionlist := BrokerPartitionGet(etcdconn)
+		partitionChan = BrokerPartitionWatch(p.watchctx, etcdconn)
+
+		err := p.reload(etcdconn)
+		if err != nil {
+			log.Println("partition reload failed!", err.Error())
+		}
+	}
+}
+
+/* 读取失败时不修改本地分区, 分区记录已经不存在的本地分区删除 */
+func (p *PartitionManager) reload(etcdconn *EtcdConn) error {
+	partitionlist, err := BrokerPartitionGet(etcdconn)
+	if err != nil {
+		return err
+	}
+
+	exist := make(map[string]bool, len(partitionlist))
+	for _, v := range partitionlist {
+		exist[v.PartitionID] = true
+		p.Add(v)
+	}
+
+	p.RLock()
+	removed := make([]string, 0)
+	for id := range p.PartitionCfg {
+		if exist[id] == false {
+			removed = append(removed, id)
+		}
+	}
+	p.RUnlock()
+
+	for _, id := range removed {
+		p.Delete(id)
+	}
+
+	return nil
+}
+
+func BrokerPartitionInit(etcdconn *EtcdConn) error {
+
+	partitionChan := BrokerPartitionWatch(gPartitionMng.watchctx, etcdconn)
+
+	go gPartitionMng.watch(etcdconn, partitionChan)
+
+	/* 读取失败时不能按空列表处理, 否则会删除本地所有的分区目录 */
+	partitionlist, err := BrokerPartitionGet(etcdconn)
+	if err != nil {
+		return err
+	}
 	if len(partitionlist) == 0 {
-		return
+		return nil
 	}
 
+	exist := make(map[string]bool, len(partitionlist))
 	for _, v := range partitionlist {
+		exist[v.PartitionID] = true
 		gPartitionMng.Add(v)
+		if stringsHas(replicaBrokers(&v), gPartitionMng.BrokerName) == false {
+			RemoveWorkPath(v.PartitionID)
+		}
+	}
+
+	/* broker 离线期间 topic 被删除, 分区记录已经不存在 */
+	for _, id := range WorkPathList() {
+		if exist[id] == false {
+			RemoveWorkPath(id)
+		}
 	}
+
+	return nil
 }
 
 func BrokerStart(name string, endpoint string, etcds []string) error {
@@ -179,14 +504,35 @@ func BrokerStart(name string, endpoint string, etcds []string) error {
 
 	gPartitionMng.BrokerName = name
 
-	err = BrokerRegister(name, endpoint)
+	server, err := NewBrokerServer(endpoint)
 	if err != nil {
 		return err
 	}
+	defer server.Stop()
 
-	BrokerPartitionInit(etcdconn)
+	grpcserver := grpcStart()
+	if grpcserver != nil {
+		defer grpcserver.Stop()
+	}
 
-	for {
-		time.Sleep(1 * time.Second)
+	httpserver := httpStart()
+	if httpserver != nil {
+		defer httpserver.Stop()
 	}
+
+	err = BrokerRegister(name, endpoint)
+	if err != nil {
+		return err
+	}
+
+	err = BrokerPartitionInit(etcdconn)
+	if err != nil {
+		return err
+	}
+	BrokerControllerStart(gPartitionMng.watchctx, etcdconn, name)
+	BrokerCleanerStart(gPartitionMng.watchctx, etcdconn)
+
+	log.Println("broker [" + name + "] listen on " + server.Addr)
+
+	return server.Serve()
 }
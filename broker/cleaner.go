@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	CLEANER_INTERVAL    = 30 * time.Second
+	TOMBSTONE_RETENTION = 24 * time.Hour
+)
+
+/*
+ * 每个 broker 定期按 topic 的清理策略清理本地的分区副本, 主副本和从副本各自清理,
+ * 同时让 topic 落盘策略的修改生效.
+ * 保留策略只删除整个段, 删除后分区的日志起始偏移后移; 压缩策略重写旧段, 偏移不再连续.
+ */
+type cleaner struct {
+	etcdconn *EtcdConn
+}
+
+/* 本地分区副本以及所属的 topic */
+func (p *PartitionManager) localPartitions() map[*Partition]string {
+	p.RLock()
+	defer p.RUnlock()
+
+	list := make(map[*Partition]string, len(p.PartitionSeg))
+	for id, part := range p.PartitionSeg {
+		list[part] = p.PartitionCfg[id].Topic
+	}
+	return list
+}
+
+func (c *cleaner) clean() {
+	list, err := BrokerTopicGet(c.etcdconn)
+	if err != nil {
+		log.Println("cleaner get topic failed!", err.Error())
+		return
+	}
+
+	topics := make(map[string]DataTopic, 0)
+	for _, v := range list {
+		topics[v.Topic] = v
+	}
+
+	for part, name := range gPartitionMng.localPartitions() {
+		topic, b := topics[name]
+		if b == false {
+			continue
+		}
+
+		/* topic 的落盘策略修改后在这里生效 */
+		policy, err := topic.SyncPolicy()
+		if err == nil {
+			part.SetSyncPolicy(policy)
+		}
+
+		if topic.RetentionMs > 0 || topic.RetentionBytes > 0 {
+			part.Retain(time.Duration(topic.RetentionMs)*time.Millisecond, topic.RetentionBytes)
+		}
+
+		if topic.Compact {
+			tombstone := time.Duration(topic.TombstoneMs) * time.Millisecond
+			if tombstone <= 0 {
+				tombstone = TOMBSTONE_RETENTION
+			}
+			part.Compact(tombstone)
+		}
+	}
+}
+
+func (c *cleaner) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(CLEANER_INTERVAL):
+		}
+
+		c.clean()
+	}
+}
+
+func BrokerCleanerStart(ctx context.Context, etcdconn *EtcdConn) {
+	c := &cleaner{etcdconn: etcdconn}
+	go c.run(ctx)
+}
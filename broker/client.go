@@ -0,0 +1,306 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrClientClosed = errors.New("client is closed!")
+)
+
+/* Timestamp 为消息的创建时间, 单位毫秒, 写入时为 0 由主副本填写 */
+type Message struct {
+	Offset    uint64
+	Key       []byte
+	Timestamp int64
+	Headers   map[string]string
+	Body      []byte
+}
+
+type BrokerClient struct {
+	sync.Mutex
+
+	Addr     string
+	ClientID string
+
+	conn    net.Conn
+	wr      *bufio.Writer
+	corrid  uint32
+	pending map[uint32]chan []byte
+	closed  bool
+}
+
+func NewBrokerClient(addr string) (*BrokerClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(BrokerClient)
+	c.Addr = addr
+	c.ClientID = UUID(UUID32)
+	c.conn = conn
+	c.wr = bufio.NewWriter(conn)
+	c.pending = make(map[uint32]chan []byte, 0)
+
+	go c.recv()
+
+	return c, nil
+}
+
+func (c *BrokerClient) Close() {
+	c.shutdown()
+}
+
+func (c *BrokerClient) shutdown() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *BrokerClient) recv() {
+	rd := bufio.NewReader(c.conn)
+
+	for {
+		frame, err := readFrame(rd)
+		if err != nil {
+			c.shutdown()
+			return
+		}
+
+		var hdr RspHeader
+		dec := &decoder{buf: frame}
+		hdr.decode(dec)
+		if dec.err != nil {
+			log.Println("response header invalid!", c.Addr)
+			c.shutdown()
+			return
+		}
+
+		c.Lock()
+		ch, b := c.pending[hdr.CorrelationID]
+		delete(c.pending, hdr.CorrelationID)
+		c.Unlock()
+
+		if b == false {
+			log.Println("response correlation id not found!", c.Addr, hdr.CorrelationID)
+			continue
+		}
+
+		ch <- frame
+	}
+}
+
+/* rsp 为 nil 表示服务端不回应答, 请求发出后直接返回 */
+func (c *BrokerClient) call(key API_KEY, req message, rsp message) error {
+	hdr := ReqHeader{
+		ApiKey:        key,
+		ApiVersion:    apiVersions[key],
+		CorrelationID: atomic.AddUint32(&c.corrid, 1),
+		ClientID:      c.ClientID,
+	}
+
+	enc := &encoder{version: hdr.ApiVersion}
+	hdr.encode(enc)
+	req.encode(enc)
+
+	ch := make(chan []byte, 1)
+
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrClientClosed
+	}
+	if rsp != nil {
+		c.pending[hdr.CorrelationID] = ch
+	}
+
+	err := writeFrame(c.wr, enc.buf)
+	if err == nil {
+		err = c.wr.Flush()
+	}
+	c.Unlock()
+
+	if err != nil {
+		c.shutdown()
+		return err
+	}
+
+	if rsp == nil {
+		return nil
+	}
+
+	frame, b := <-ch
+	if b == false {
+		return ErrClientClosed
+	}
+
+	var rsphdr RspHeader
+	dec := &decoder{buf: frame, version: hdr.ApiVersion}
+	rsphdr.decode(dec)
+
+	if rsphdr.ErrCode != ERR_NONE {
+		return codeToErr(rsphdr.ErrCode, dec.String())
+	}
+
+	rsp.decode(dec)
+	return dec.err
+}
+
+/* acks=0 时不等待应答, 返回的偏移均为 INVALID_OFFSET */
+func (c *BrokerClient) ProduceAcks(partitionId string, messages [][]byte, acks ACKS, timeout time.Duration) ([]uint64, error) {
+	list := make([]Message, 0, len(messages))
+	for _, v := range messages {
+		list = append(list, Message{Body: v})
+	}
+	return c.ProduceMessages(partitionId, list, acks, timeout)
+}
+
+/* 发送带 key、创建时间和 headers 的消息 */
+func (c *BrokerClient) ProduceMessages(partitionId string, messages []Message, acks ACKS, timeout time.Duration) ([]uint64, error) {
+	req := &ProduceReq{
+		PartitionID: partitionId,
+		Messages:    messages,
+		Acks:        acks,
+		Timeout:     uint32(timeout / time.Millisecond),
+	}
+
+	if acks == ACKS_NONE {
+		err := c.call(API_PRODUCE, req, nil)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make([]uint64, len(messages))
+		for i := range offsets {
+			offsets[i] = INVALID_OFFSET
+		}
+		return offsets, nil
+	}
+
+	var rsp ProduceRsp
+
+	err := c.call(API_PRODUCE, req, &rsp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rsp.Offsets) != len(messages) {
+		return nil, ErrBadRequest
+	}
+
+	return rsp.Offsets, nil
+}
+
+func (c *BrokerClient) ProduceBatch(partitionId string, messages [][]byte) ([]uint64, error) {
+	return c.ProduceAcks(partitionId, messages, ACKS_PRIMARY, 0)
+}
+
+func (c *BrokerClient) Produce(partitionId string, message []byte) (uint64, error) {
+	offsets, err := c.ProduceBatch(partitionId, [][]byte{message})
+	if err != nil {
+		return INVALID_OFFSET, err
+	}
+	return offsets[0], nil
+}
+
+func (c *BrokerClient) fetch(req *FetchReq, rsp *FetchRsp) ([]Message, error) {
+	req.RecordVersion = MSGREC_V1
+	err := c.call(API_FETCH, req, rsp)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(rsp.Records))
+	for _, raw := range rsp.Records {
+		msgrec, err := DecodeMsgRec(raw)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgrec.Message())
+	}
+
+	return messages, nil
+}
+
+func (c *BrokerClient) FetchBatch(partitionId string, offset uint64, maxcount int, maxbytes int) ([]Message, error) {
+	messages, _, _, err := c.FetchRange(partitionId, offset, maxcount, maxbytes)
+	return messages, err
+}
+
+/* 同时返回高水位和日志起始偏移, offset 已经被清理时返回 ErrOffsetOutOfRange, 起始偏移仍然有效 */
+func (c *BrokerClient) FetchRange(partitionId string, offset uint64, maxcount int, maxbytes int) ([]Message, uint64, uint64, error) {
+	req := &FetchReq{
+		PartitionID: partitionId,
+		Offset:      offset,
+		MaxCount:    uint32(maxcount),
+		MaxBytes:    uint32(maxbytes),
+	}
+
+	var rsp FetchRsp
+	messages, err := c.fetch(req, &rsp)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(messages) == 0 && offset < rsp.LogStart {
+		return nil, rsp.HighWater, rsp.LogStart, ErrOffsetOutOfRange
+	}
+
+	return messages, rsp.HighWater, rsp.LogStart, nil
+}
+
+/* 从副本复制使用, 同时返回主副本的高水位和日志起始偏移 */
+func (c *BrokerClient) ReplicaFetch(partitionId string, replicaId string, offset uint64, maxcount int) ([]Message, uint64, uint64, error) {
+	req := &FetchReq{
+		PartitionID: partitionId,
+		Offset:      offset,
+		MaxCount:    uint32(maxcount),
+		ReplicaID:   replicaId,
+	}
+
+	var rsp FetchRsp
+	messages, err := c.fetch(req, &rsp)
+	return messages, rsp.HighWater, rsp.LogStart, err
+}
+
+func (c *BrokerClient) Fetch(partitionId string, offset uint64) ([]byte, error) {
+	messages, err := c.FetchBatch(partitionId, offset, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrNoMessage
+	}
+	return messages[0].Body, nil
+}
+
+func (c *BrokerClient) Metadata(topics ...string) (*MetadataRsp, error) {
+	rsp := new(MetadataRsp)
+
+	err := c.call(API_METADATA, &MetadataReq{Topics: topics}, rsp)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+func (c *BrokerClient) OffsetCommit(consumerId string, topic string, partitionId string, offset uint64) error {
+	req := &OffsetCommitReq{ConsumerID: consumerId, Topic: topic, PartitionID: partitionId, Offset: offset}
+	return c.call(API_OFFSET_COMMIT, req, &OffsetCommitRsp{})
+}
@@ -0,0 +1,418 @@
+package broker
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	CONSUMER_FETCHMAX = 100
+)
+
+type RESET_P int /* 消费位置已经被清理时的处理策略 */
+
+const (
+	RESET_P_EARLIEST RESET_P = iota /* 从日志起始偏移继续消费 */
+	RESET_P_LATEST                  /* 跳到高水位, 只消费之后的新消息 */
+	RESET_P_NONE                    /* 把 ErrOffsetOutOfRange 返回给调用者, 由调用者 Seek */
+)
+
+var (
+	ErrNotSubscribe = errors.New("topic is not subscribe!")
+	ErrInGroup      = errors.New("consumer is already in group!")
+)
+
+type ConsumerMessage struct {
+	Topic       string
+	PartitionID string
+	Message
+}
+
+/* 分区的消费位置, offset 为已经消费的最后一条消息, generation 为消费组中认领分区时的代数 */
+type consumerPart struct {
+	topic       string
+	partitionId string
+	offset      uint64
+	generation  int64
+}
+
+/*
+ * DataSubscribe.Offset 记录已经消费的最后一条消息, 重启后从下一条开始.
+ * 单独消费时偏移记录在 KEY_CONSUMER/<consumer>, 加入消费组后记录在 KEY_GROUPOFFSET/<group>/<partition>.
+ */
+type Consumer struct {
+	sync.Mutex
+
+	ConsumerID  string
+	OffsetReset RESET_P
+
+	router *router
+	group  *consumerGroup
+	topics []string
+	parts  map[string]*consumerPart
+}
+
+func NewConsumer(consumerId string, etcds []string) (*Consumer, error) {
+	c := new(Consumer)
+	c.ConsumerID = consumerId
+	c.parts = make(map[string]*consumerPart, 0)
+
+	router, err := newRouter(consumerId, etcds)
+	if err != nil {
+		return nil, err
+	}
+	c.router = router
+
+	return c, nil
+}
+
+func (c *Consumer) Close() {
+	if c.group != nil {
+		err := c.Commit()
+		if err != nil {
+			log.Println("consumer commit failed!", c.ConsumerID, err.Error())
+		}
+		c.group.leave()
+	}
+	c.router.close()
+}
+
+func (c *Consumer) topicOf(partitionId string) string {
+	for _, topic := range c.topics {
+		list, err := c.router.topicPartitions(topic)
+		if err != nil {
+			continue
+		}
+		for _, v := range list {
+			if v == partitionId {
+				return topic
+			}
+		}
+	}
+	return ""
+}
+
+/* 切换到新的分区列表, 新增分区从 etcd 中记录的偏移开始消费 */
+func (c *Consumer) assign(partitions []string) error {
+	consumer, err := BrokerConsumerGet(c.router.etcdconn, c.ConsumerID)
+	if err != nil {
+		return err
+	}
+
+	parts := make(map[string]*consumerPart, len(partitions))
+
+	c.Lock()
+	for _, partitionId := range partitions {
+		part, b := c.parts[partitionId]
+		if b == false {
+			part = &consumerPart{topic: c.topicOf(partitionId), partitionId: partitionId}
+			sub := consumer.Find(part.topic, partitionId)
+			if sub != nil {
+				part.offset = sub.Offset
+			}
+		}
+		parts[partitionId] = part
+	}
+	c.parts = parts
+	c.Unlock()
+
+	log.Println("consumer assign partitions", c.ConsumerID, partitions)
+
+	return nil
+}
+
+func (c *Consumer) Subscribe(topics ...string) error {
+	if c.group != nil {
+		return ErrInGroup
+	}
+
+	c.topics = topics
+
+	partitions := make([]string, 0)
+	for _, topic := range topics {
+		list, err := c.router.topicPartitions(topic)
+		if err != nil {
+			return err
+		}
+		partitions = append(partitions, list...)
+	}
+
+	return c.assign(partitions)
+}
+
+/* 加入消费组, 与组内其他成员分摊所订阅主题的分区 */
+func (c *Consumer) JoinGroup(group string, strategy string, topics ...string) error {
+	if c.group != nil {
+		return ErrInGroup
+	}
+
+	member := DataGroupMember{ConsumerID: c.ConsumerID, Topics: topics, Strategy: strategy}
+
+	g, err := newConsumerGroup(c.router.etcdconn, group, member)
+	if err != nil {
+		return err
+	}
+
+	c.group = g
+	c.topics = topics
+
+	return nil
+}
+
+/*
+ * 成员变化后先提交当前偏移并释放不再分给自己的分区, 再认领新分到的分区.
+ * 原来的成员还没有释放的分区暂时不消费, 下一次 Poll 时重新认领.
+ */
+func (c *Consumer) rebalance() error {
+	partitions, err := c.group.assign(c.router.topicPartitions)
+	if err != nil {
+		return err
+	}
+
+	err = c.Commit()
+	if err != nil && err != ErrGroupFenced {
+		return err
+	}
+
+	released := make([]consumerPart, 0)
+
+	c.Lock()
+	for partitionId, part := range c.parts {
+		if stringsHas(partitions, partitionId) == false {
+			released = append(released, *part)
+			delete(c.parts, partitionId)
+		}
+	}
+	c.Unlock()
+
+	for _, part := range released {
+		err = c.group.release(part.partitionId, part.generation)
+		if err != nil {
+			log.Println("consumer release partition failed!", c.ConsumerID, part.partitionId, err.Error())
+		}
+	}
+
+	pending := make([]string, 0)
+
+	for _, partitionId := range partitions {
+		c.Lock()
+		_, b := c.parts[partitionId]
+		c.Unlock()
+		if b {
+			continue
+		}
+
+		generation, err := c.group.claim(partitionId)
+		if err != nil {
+			return err
+		}
+		if generation == 0 {
+			pending = append(pending, partitionId)
+			continue
+		}
+
+		part := &consumerPart{topic: c.topicOf(partitionId), partitionId: partitionId, generation: generation}
+		sub, err := c.group.offset(partitionId)
+		if err != nil {
+			c.group.release(partitionId, generation)
+			return err
+		}
+		if sub != nil {
+			part.offset = sub.Offset
+		}
+
+		c.Lock()
+		c.parts[partitionId] = part
+		c.Unlock()
+	}
+
+	if len(pending) > 0 {
+		log.Println("consumer wait partitions released", c.ConsumerID, pending)
+		atomic.StoreInt32(&c.group.changed, 1)
+	}
+
+	log.Println("consumer assign partitions", c.ConsumerID, c.Assignment())
+
+	return nil
+}
+
+func (c *Consumer) Assignment() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	list := make([]string, 0, len(c.parts))
+	for partitionId := range c.parts {
+		list = append(list, partitionId)
+	}
+	return list
+}
+
+func (c *Consumer) Seek(partitionId string, offset uint64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	part, b := c.parts[partitionId]
+	if b == false {
+		return ErrNotSubscribe
+	}
+
+	part.offset = offset
+	return nil
+}
+
+func (c *Consumer) Position(partitionId string) (uint64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	part, b := c.parts[partitionId]
+	if b == false {
+		return 0, ErrNotSubscribe
+	}
+
+	return part.offset, nil
+}
+
+func (c *Consumer) fetch(part consumerPart, maxcount int) ([]ConsumerMessage, error) {
+	client, err := c.router.routePartition(part.partitionId)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, hw, start, err := client.FetchRange(part.partitionId, part.offset+1, maxcount, 0)
+	if err == ErrOffsetOutOfRange && c.OffsetReset != RESET_P_NONE {
+		c.reset(part, hw, start)
+		return nil, nil
+	}
+	if err != nil {
+		if err != ErrOffsetOutOfRange {
+			c.router.invalid(client)
+		}
+		return nil, err
+	}
+
+	list := make([]ConsumerMessage, 0, len(messages))
+	for _, v := range messages {
+		list = append(list, ConsumerMessage{Topic: part.topic, PartitionID: part.partitionId, Message: v})
+	}
+
+	return list, nil
+}
+
+/* 要消费的消息已经按保留策略删除, 按 OffsetReset 重新设置消费位置, 下一次 Poll 生效 */
+func (c *Consumer) reset(part consumerPart, hw uint64, start uint64) {
+	offset := offsetBefore(start)
+	if c.OffsetReset == RESET_P_LATEST {
+		offset = hw
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	/* 期间调用者已经 Seek 或者分区重新分配时不修改 */
+	cur, b := c.parts[part.partitionId]
+	if b == false || cur.offset != part.offset {
+		return
+	}
+	cur.offset = offset
+
+	log.Println("consumer offset out of range, reset!", c.ConsumerID, part.partitionId, part.offset, "->", offset)
+}
+
+/* 从每个分配到的分区拉取消息, 没有新消息时返回空列表 */
+func (c *Consumer) Poll(maxcount int) ([]ConsumerMessage, error) {
+	if maxcount <= 0 || maxcount > CONSUMER_FETCHMAX {
+		maxcount = CONSUMER_FETCHMAX
+	}
+
+	if c.group != nil && c.group.rebalanced() {
+		err := c.rebalance()
+		if err != nil {
+			atomic.StoreInt32(&c.group.changed, 1)
+			return nil, err
+		}
+	}
+
+	c.Lock()
+	parts := make([]consumerPart, 0, len(c.parts))
+	for _, v := range c.parts {
+		parts = append(parts, *v)
+	}
+	c.Unlock()
+
+	list := make([]ConsumerMessage, 0)
+
+	for _, part := range parts {
+		messages, err := c.fetch(part, maxcount)
+		if err != nil {
+			return list, err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		c.Lock()
+		cur, b := c.parts[part.partitionId]
+		if b && cur.offset == part.offset {
+			cur.offset = messages[len(messages)-1].Offset
+		}
+		c.Unlock()
+
+		list = append(list, messages...)
+	}
+
+	return list, nil
+}
+
+/* 消费组中的分区已经被其他成员认领时不再提交该分区, 从分配结果中去掉并返回 ErrGroupFenced */
+func (c *Consumer) Commit() error {
+	c.Lock()
+	parts := make([]consumerPart, 0, len(c.parts))
+	for _, v := range c.parts {
+		parts = append(parts, *v)
+	}
+	c.Unlock()
+
+	if len(parts) == 0 {
+		return nil
+	}
+
+	if c.group != nil {
+		return c.commitGroup(parts)
+	}
+
+	return BrokerConsumerUpdate(c.router.etcdconn, c.ConsumerID, func(consumer *DataConsumer) {
+		for _, v := range parts {
+			consumer.Update(v.topic, v.partitionId, v.offset)
+		}
+	})
+}
+
+func (c *Consumer) commitGroup(parts []consumerPart) error {
+	var fenced error
+
+	for _, v := range parts {
+		sub := DataSubscribe{Topic: v.topic, PartitionID: v.partitionId, Offset: v.offset}
+		err := c.group.commit(sub, v.generation)
+		if err == ErrGroupFenced {
+			log.Println("consumer partition is fenced!", c.ConsumerID, v.partitionId, v.generation)
+
+			c.Lock()
+			cur, b := c.parts[v.partitionId]
+			if b && cur.generation == v.generation {
+				delete(c.parts, v.partitionId)
+			}
+			c.Unlock()
+
+			atomic.StoreInt32(&c.group.changed, 1)
+			fenced = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return fenced
+}
@@ -0,0 +1,557 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+const (
+	CONTROLLER_INTERVAL = 5 * time.Second
+	CONTROLLER_DEADTIME = 60 * time.Second
+	CONTROLLER_ELECTGAP = 5 * time.Minute
+)
+
+/*
+ * 所有 broker 通过 KEY_CONTROLLER 竞选, 当选的 broker 作为控制器定期对比 DataCommon、
+ * topic 的配置和实际的分区, 存活的 broker: 补齐缺少的分区和副本, 替换下线超过 CONTROLLER_DEADTIME
+ * 的 broker 上的副本, 执行 KEY_REASSIGN 下的迁移请求, 并在 broker 之间均衡副本数量.
+ * 失去租约后重新竞选.
+ */
+type controller struct {
+	etcdconn *EtcdConn
+	name     string
+	dead     map[string]time.Time /* broker 第一次发现下线的时间 */
+}
+
+/* 各可用 broker 上的副本数量, 以及所在的机架 */
+type brokerLoad struct {
+	count map[string]int
+	racks map[string]string
+}
+
+func newBrokerLoad(brokers []DataBroker, partitions []DataPartition) *brokerLoad {
+	load := &brokerLoad{
+		count: make(map[string]int, len(brokers)),
+		racks: make(map[string]string, len(brokers)),
+	}
+	for _, v := range brokers {
+		load.count[v.Broker] = 0
+		load.racks[v.Broker] = v.Rack
+	}
+	for _, v := range partitions {
+		for _, rep := range v.Replicas {
+			if _, b := load.count[rep.Broker]; b {
+				load.count[rep.Broker]++
+			}
+		}
+	}
+	return load
+}
+
+func (load *brokerLoad) names() []string {
+	list := make([]string, 0, len(load.count))
+	for name := range load.count {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+/* brokers 中是否有 broker 与 name 在同一个机架, 没有配置机架的 broker 不算 */
+func (load *brokerLoad) sameRack(brokers []string, name string) bool {
+	rack := load.racks[name]
+	if rack == "" {
+		return false
+	}
+	for _, v := range brokers {
+		if v != name && load.racks[v] == rack {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * 选择不在 exclude 中的 broker, 优先选择与 exclude 不在同一个机架的,
+ * 其次选择副本最少的, 没有可选的返回空.
+ */
+func (load *brokerLoad) pick(exclude []string) string {
+	var broker string
+	var brokerSame bool
+	for _, name := range load.names() {
+		if stringsHas(exclude, name) {
+			continue
+		}
+		same := load.sameRack(exclude, name)
+		if broker == "" || (brokerSame && same == false) ||
+			(brokerSame == same && load.count[name] < load.count[broker]) {
+			broker, brokerSame = name, same
+		}
+	}
+	return broker
+}
+
+func replicaBrokers(partition *DataPartition) []string {
+	list := make([]string, 0, len(partition.Replicas))
+	for _, rep := range partition.Replicas {
+		list = append(list, rep.Broker)
+	}
+	return list
+}
+
+/* topic 的分区记录自带副本数量, 其他分区使用 DataCommon 的配置 num */
+func replicasNum(partition *DataPartition, num int) int {
+	if partition.ReplicasNum > 0 {
+		return partition.ReplicasNum
+	}
+	return num
+}
+
+func newPartitionPlace(num int, load *brokerLoad) *DataPartition {
+	partition := &DataPartition{PartitionID: UUID(UUID64), Status: PART_S_FREE}
+
+	for i := 0; i < num; i++ {
+		broker := load.pick(replicaBrokers(partition))
+		if broker == "" {
+			break
+		}
+		load.count[broker]++
+
+		role := PART_S_FOLLOW
+		if i == 0 {
+			role = PART_S_PRIMARY
+		}
+		partition.Replicas = append(partition.Replicas, PartReplicas{Broker: broker, Role: role})
+		partition.ISR = append(partition.ISR, broker)
+	}
+
+	return partition
+}
+
+func failoverDead(partition *DataPartition, alive map[string]bool) bool {
+	changed := false
+	for _, broker := range replicaBrokers(partition) {
+		if alive[broker] == false && partitionFailover(partition, broker, alive) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+/* 修正单个分区的副本, 返回 false 表示不需要修改 */
+func reconcilePartition(partition *DataPartition, num int, alive map[string]bool, expired map[string]bool, load *brokerLoad) bool {
+	changed := failoverDead(partition, alive)
+
+	/* 下线太久的从副本换到其他 broker, 新副本追上后加入同步副本集合 */
+	for i, rep := range partition.Replicas {
+		if expired[rep.Broker] == false || rep.Role == PART_S_PRIMARY {
+			continue
+		}
+		broker := load.pick(replicaBrokers(partition))
+		if broker == "" {
+			continue
+		}
+		load.count[broker]++
+
+		log.Println("partition replica replace!", partition.PartitionID, rep.Broker, "->", broker)
+
+		partition.Replicas[i] = PartReplicas{Broker: broker, Role: PART_S_FOLLOW}
+		changed = true
+	}
+
+	for len(partition.Replicas) < num {
+		broker := load.pick(replicaBrokers(partition))
+		if broker == "" {
+			break
+		}
+		load.count[broker]++
+
+		log.Println("partition replica add!", partition.PartitionID, broker)
+
+		partition.Replicas = append(partition.Replicas, PartReplicas{Broker: broker, Role: PART_S_FOLLOW})
+		changed = true
+	}
+
+	/* 副本多于配置时, 等所有副本都同步后删除从副本, 优先删除机架重复的, 其次是负载最高的 */
+	if len(partition.Replicas) > num {
+		brokers := replicaBrokers(partition)
+		remove := -1
+		removeSame := false
+		for i, rep := range partition.Replicas {
+			if stringsHas(partition.ISR, rep.Broker) == false {
+				return changed
+			}
+			if rep.Role == PART_S_PRIMARY {
+				continue
+			}
+			same := load.sameRack(brokers, rep.Broker)
+			if remove == -1 || (same && removeSame == false) ||
+				(same == removeSame && load.count[rep.Broker] > load.count[partition.Replicas[remove].Broker]) {
+				remove, removeSame = i, same
+			}
+		}
+		if remove != -1 {
+			rep := partition.Replicas[remove]
+			load.count[rep.Broker]--
+
+			log.Println("partition replica remove!", partition.PartitionID, rep.Broker)
+
+			partition.Replicas = append(partition.Replicas[:remove], partition.Replicas[remove+1:]...)
+			isr := make([]string, 0, len(partition.ISR))
+			for _, v := range partition.ISR {
+				if v != rep.Broker {
+					isr = append(isr, v)
+				}
+			}
+			partition.ISR = isr
+			changed = true
+		}
+	}
+
+	list := make([]string, 0, len(partition.ISR))
+	for _, v := range partition.ISR {
+		if stringsHas(replicaBrokers(partition), v) {
+			list = append(list, v)
+		}
+	}
+	if len(list) != len(partition.ISR) {
+		partition.ISR = list
+		changed = true
+	}
+
+	return changed
+}
+
+/*
+ * 按迁移请求调整分区副本: 先把新副本作为从副本加入, 新副本都进入同步副本集合后,
+ * 一次 CAS 把副本列表切换为目标列表. 返回分区是否修改, 以及迁移是否完成.
+ */
+func reassignPartition(partition *DataPartition, target []string, alive map[string]bool) (bool, bool) {
+	changed := failoverDead(partition, alive)
+
+	brokers := replicaBrokers(partition)
+	for _, broker := range target {
+		if stringsHas(brokers, broker) == false {
+			partition.Replicas = append(partition.Replicas, PartReplicas{Broker: broker, Role: PART_S_FOLLOW})
+			changed = true
+		}
+	}
+
+	var primary string
+	for _, rep := range partition.Replicas {
+		if rep.Role == PART_S_PRIMARY {
+			primary = rep.Broker
+		}
+	}
+
+	for _, broker := range target {
+		if stringsHas(partition.ISR, broker) == false {
+			return changed, false
+		}
+		if stringsHas(target, primary) == false && alive[broker] {
+			primary = broker
+		}
+	}
+
+	if stringsHas(target, primary) == false {
+		return changed, false
+	}
+
+	if len(partition.Replicas) == len(target) {
+		return changed, true
+	}
+
+	replicas := make([]PartReplicas, 0, len(target))
+	for _, broker := range target {
+		role := PART_S_FOLLOW
+		if broker == primary {
+			role = PART_S_PRIMARY
+		}
+		replicas = append(replicas, PartReplicas{Broker: broker, Role: role})
+	}
+
+	isr := make([]string, 0, len(target))
+	for _, broker := range partition.ISR {
+		if stringsHas(target, broker) {
+			isr = append(isr, broker)
+		}
+	}
+
+	log.Println("partition reassign!", partition.PartitionID, replicaBrokers(partition), "->", target)
+
+	partition.Replicas = replicas
+	partition.ISR = isr
+
+	return true, true
+}
+
+/*
+ * 负载最高和最低的 broker 相差超过 1 时, 在负载最低的 broker 上为一个分区增加从副本,
+ * 新副本同步后由 reconcilePartition 删除多余的副本. 每次只迁移一个副本.
+ */
+func rebalancePartition(partitions []DataPartition, num int, load *brokerLoad) *DataPartition {
+	var max, min string
+	for _, name := range load.names() {
+		if max == "" || load.count[name] > load.count[max] {
+			max = name
+		}
+		if min == "" || load.count[name] < load.count[min] {
+			min = name
+		}
+	}
+
+	if load.count[max]-load.count[min] <= 1 {
+		return nil
+	}
+
+	for i := range partitions {
+		if len(partitions[i].Replicas) > replicasNum(&partitions[i], num) {
+			return nil
+		}
+	}
+
+	for i := range partitions {
+		partition := &partitions[i]
+		brokers := replicaBrokers(partition)
+		if stringsHas(brokers, min) {
+			continue
+		}
+		/* 不把两个副本放到同一个机架 */
+		if load.racks[min] != load.racks[max] && load.sameRack(brokers, min) {
+			continue
+		}
+		for _, rep := range partition.Replicas {
+			if rep.Broker == max && rep.Role == PART_S_FOLLOW {
+				load.count[min]++
+
+				log.Println("partition rebalance!", partition.PartitionID, max, "->", min)
+
+				partition.Replicas = append(partition.Replicas, PartReplicas{Broker: min, Role: PART_S_FOLLOW})
+				return partition
+			}
+		}
+	}
+
+	return nil
+}
+
+/* 读取集群状态失败时跳过这一轮, 下一个周期重试, 不能按空列表处理 */
+func (c *controller) load() (*DataCommon, []DataBroker, []DataPartition, map[string]bool, map[string]DataReassign, error) {
+	cfg, err := BrokerPublicGet(c.etcdconn)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	brokers, err := BrokerServerGet(c.etcdconn)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	partitions, err := BrokerPartitionGet(c.etcdconn)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	decommission, err := BrokerDecommissionGet(c.etcdconn)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	reassigns, err := BrokerReassignGet(c.etcdconn)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	return cfg, brokers, partitions, decommission, reassigns, nil
+}
+
+func (c *controller) reconcile() {
+	cfg, brokers, partitions, decommission, reassigns, err := c.load()
+	if err != nil {
+		log.Println("controller load cluster failed!", err.Error())
+		return
+	}
+
+	alive := make(map[string]bool, len(brokers))
+	for _, v := range brokers {
+		alive[v.Broker] = true
+		delete(c.dead, v.Broker)
+	}
+
+	now := time.Now()
+	expired := make(map[string]bool, 0)
+	for _, v := range partitions {
+		for _, rep := range v.Replicas {
+			if alive[rep.Broker] {
+				continue
+			}
+			first, b := c.dead[rep.Broker]
+			if b == false {
+				c.dead[rep.Broker] = now
+			} else if now.Sub(first) > CONTROLLER_DEADTIME {
+				expired[rep.Broker] = true
+			}
+		}
+	}
+
+	/* 下线中的 broker 不参与副本放置 */
+	available := make([]DataBroker, 0, len(brokers))
+	for _, v := range brokers {
+		if decommission[v.Broker] == false {
+			available = append(available, v)
+		}
+	}
+
+	load := newBrokerLoad(available, partitions)
+
+	for _, v := range partitions {
+		reassign, b := reassigns[v.PartitionID]
+		if b {
+			c.reassign(reassign, alive)
+			continue
+		}
+
+		err := BrokerPartitionUpdate(c.etcdconn, v.PartitionID, func(partition *DataPartition) bool {
+			num := replicasNum(partition, cfg.ReplicasNum)
+			if num <= 0 {
+				return false
+			}
+			return reconcilePartition(partition, num, alive, expired, load)
+		})
+		if err != nil {
+			log.Println("partition reconcile failed!", v.PartitionID, err.Error())
+		}
+	}
+
+	/* DataCommon 只配置不属于 topic 的分区 */
+	common := 0
+	for _, v := range partitions {
+		if v.Topic == "" {
+			common++
+		}
+	}
+
+	for i := common; i < cfg.PartitionNum && cfg.ReplicasNum > 0 && len(available) > 0; i++ {
+		partition := newPartitionPlace(cfg.ReplicasNum, load)
+
+		err := BrokerPartitionPut(c.etcdconn, *partition)
+		if err != nil {
+			log.Println("partition create failed!", err.Error())
+			return
+		}
+		log.Println("partition create!", *partition)
+	}
+
+	/* 有 broker 下线或者有迁移请求时先不均衡 */
+	if len(c.dead) != 0 || len(reassigns) != 0 {
+		return
+	}
+
+	partition := rebalancePartition(partitions, cfg.ReplicasNum, load)
+	if partition != nil {
+		add := partition.Replicas[len(partition.Replicas)-1]
+		err := BrokerPartitionUpdate(c.etcdconn, partition.PartitionID, func(p *DataPartition) bool {
+			if len(p.Replicas) > replicasNum(p, cfg.ReplicasNum) || stringsHas(replicaBrokers(p), add.Broker) {
+				return false
+			}
+			p.Replicas = append(p.Replicas, add)
+			return true
+		})
+		if err != nil {
+			log.Println("partition rebalance failed!", partition.PartitionID, err.Error())
+		}
+	}
+}
+
+func (c *controller) reassign(reassign DataReassign, alive map[string]bool) {
+	var done bool
+
+	err := BrokerPartitionUpdate(c.etcdconn, reassign.PartitionID, func(partition *DataPartition) bool {
+		var changed bool
+		changed, done = reassignPartition(partition, reassign.Replicas, alive)
+		return changed
+	})
+	if err != nil {
+		log.Println("partition reassign failed!", reassign.PartitionID, err.Error())
+		return
+	}
+
+	if done {
+		err = BrokerReassignDelete(c.etcdconn, reassign.PartitionID)
+		if err != nil {
+			log.Println("partition reassign delete failed!", reassign.PartitionID, err.Error())
+			return
+		}
+		log.Println("partition reassign finish!", reassign.PartitionID, reassign.Replicas)
+	}
+}
+
+/* 当选后一直工作到失去租约或者退出 */
+func (c *controller) lead(ctx context.Context, session *concurrency.Session) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	BrokerFailoverWatch(ctx, c.etcdconn)
+
+	elect := time.Now()
+
+	for {
+		c.reconcile()
+
+		/* 定期把主副本切换回首选副本, 使各 broker 上的主副本数量均衡 */
+		if time.Since(elect) > CONTROLLER_ELECTGAP {
+			elect = time.Now()
+			count, err := BrokerPreferredElect(c.etcdconn, "")
+			if err != nil {
+				log.Println("controller preferred elect failed!", err.Error())
+			} else if count > 0 {
+				log.Println("controller preferred elect partitions", count)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.Done():
+			log.Println("controller session expire!", c.name)
+			return
+		case <-time.After(CONTROLLER_INTERVAL):
+		}
+	}
+}
+
+func (c *controller) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		session, err := concurrency.NewSession(c.etcdconn.Call(),
+			concurrency.WithTTL(defaultTTL), concurrency.WithContext(ctx))
+		if err != nil {
+			log.Println("controller session failed!", err.Error())
+			time.Sleep(defaultTimeout)
+			continue
+		}
+
+		election := concurrency.NewElection(session, KEY_CONTROLLER)
+
+		err = election.Campaign(ctx, c.name)
+		if err != nil && ctx.Err() == nil {
+			log.Println("controller campaign failed!", err.Error())
+			time.Sleep(defaultTimeout)
+		}
+		if err == nil {
+			log.Println("controller elected!", c.name)
+
+			c.dead = make(map[string]time.Time, 0)
+			c.lead(ctx, session)
+
+			rctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+			election.Resign(rctx)
+			cancel()
+		}
+
+		session.Close()
+	}
+}
+
+func BrokerControllerStart(ctx context.Context, etcdconn *EtcdConn, name string) {
+	c := &controller{etcdconn: etcdconn, name: name}
+	go c.run(ctx)
+}
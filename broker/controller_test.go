@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestController01(t *testing.T) {
+	brokers := []DataBroker{{Broker: "broker1"}, {Broker: "broker2"}, {Broker: "broker3"}}
+	load := newBrokerLoad(brokers, nil)
+
+	partitions := make([]DataPartition, 0)
+	for i := 0; i < 3; i++ {
+		partitions = append(partitions, *newPartitionPlace(2, load))
+	}
+
+	for _, name := range load.names() {
+		if load.count[name] != 2 {
+			t.Errorf("broker %s load %d invalid!", name, load.count[name])
+		}
+	}
+
+	for _, v := range partitions {
+		if len(v.Replicas) != 2 || v.Replicas[0].Role != PART_S_PRIMARY || len(v.ISR) != 2 {
+			t.Errorf("partition place invalid! %v", v)
+		}
+	}
+}
+
+func TestController02(t *testing.T) {
+	partition := DataPartition{
+		PartitionID: "0x123",
+		Replicas: []PartReplicas{
+			{Broker: "broker1", Role: PART_S_PRIMARY},
+			{Broker: "broker2", Role: PART_S_FOLLOW},
+		},
+		ISR: []string{"broker1", "broker2"},
+	}
+
+	alive := map[string]bool{"broker1": true, "broker3": true}
+	expired := map[string]bool{"broker2": true}
+	load := newBrokerLoad([]DataBroker{{Broker: "broker1"}, {Broker: "broker3"}}, nil)
+	load.count["broker1"] = 1
+
+	if reconcilePartition(&partition, 2, alive, expired, load) == false {
+		t.Errorf("partition should be reconcile!")
+		return
+	}
+
+	if partition.Replicas[1].Broker != "broker3" || len(partition.ISR) != 1 {
+		t.Errorf("dead replica should be replaced! %v", partition)
+	}
+
+	if reconcilePartition(&partition, 2, alive, expired, load) {
+		t.Errorf("partition should not change again! %v", partition)
+	}
+}
+
+func TestController03(t *testing.T) {
+	partitions := []DataPartition{
+		{
+			PartitionID: "0x1",
+			Replicas:    []PartReplicas{{Broker: "broker1", Role: PART_S_PRIMARY}, {Broker: "broker2", Role: PART_S_FOLLOW}},
+			ISR:         []string{"broker1", "broker2"},
+		},
+		{
+			PartitionID: "0x2",
+			Replicas:    []PartReplicas{{Broker: "broker2", Role: PART_S_PRIMARY}, {Broker: "broker1", Role: PART_S_FOLLOW}},
+			ISR:         []string{"broker2", "broker1"},
+		},
+	}
+
+	brokers := []DataBroker{{Broker: "broker1"}, {Broker: "broker2"}, {Broker: "broker3"}}
+	load := newBrokerLoad(brokers, partitions)
+
+	partition := rebalancePartition(partitions, 2, load)
+	if partition == nil || len(partition.Replicas) != 3 || partition.Replicas[2].Broker != "broker3" {
+		t.Errorf("partition should rebalance to broker3! %v", partition)
+		return
+	}
+
+	if rebalancePartition(partitions, 2, load) != nil {
+		t.Errorf("only one partition should move at once!")
+	}
+
+	alive := map[string]bool{"broker1": true, "broker2": true, "broker3": true}
+
+	reconcilePartition(partition, 2, alive, nil, load)
+	if len(partition.Replicas) != 3 {
+		t.Errorf("replica should not remove before in sync! %v", partition)
+	}
+
+	partition.ISR = append(partition.ISR, "broker3")
+	reconcilePartition(partition, 2, alive, nil, load)
+	if len(partition.Replicas) != 2 || partition.Replicas[1].Broker != "broker3" {
+		t.Errorf("replica should remove after in sync! %v", partition)
+	}
+}
+
+func TestController04(t *testing.T) {
+	partition := DataPartition{
+		PartitionID: "0x123",
+		Replicas: []PartReplicas{
+			{Broker: "broker1", Role: PART_S_PRIMARY},
+			{Broker: "broker2", Role: PART_S_FOLLOW},
+		},
+		ISR: []string{"broker1", "broker2"},
+	}
+
+	alive := map[string]bool{"broker1": true, "broker2": true, "broker3": true, "broker4": true}
+	target := []string{"broker3", "broker4"}
+
+	changed, done := reassignPartition(&partition, target, alive)
+	if changed == false || done || len(partition.Replicas) != 4 {
+		t.Errorf("new replicas should be added first! %v", partition)
+		return
+	}
+
+	partition.ISR = append(partition.ISR, "broker3", "broker4")
+
+	changed, done = reassignPartition(&partition, target, alive)
+	if changed == false || done == false {
+		t.Errorf("partition should switch to target! %v", partition)
+		return
+	}
+
+	if len(partition.Replicas) != 2 || partition.Replicas[0].Role != PART_S_PRIMARY ||
+		partition.Replicas[0].Broker != "broker3" || len(partition.ISR) != 2 {
+		t.Errorf("partition reassign invalid! %v", partition)
+	}
+
+	changed, done = reassignPartition(&partition, target, alive)
+	if changed || done == false {
+		t.Errorf("partition reassign should be done! %v", partition)
+	}
+}
+
+func TestController05(t *testing.T) {
+	brokers := []DataBroker{
+		{Broker: "broker1", Rack: "rack1"},
+		{Broker: "broker2", Rack: "rack1"},
+		{Broker: "broker3", Rack: "rack2"},
+		{Broker: "broker4", Rack: "rack2"},
+		{Broker: "broker5", Rack: "rack3"},
+		{Broker: "broker6", Rack: "rack3"},
+	}
+	load := newBrokerLoad(brokers, nil)
+
+	for i := 0; i < 6; i++ {
+		partition := newPartitionPlace(3, load)
+
+		racks := make(map[string]bool, 0)
+		for _, rep := range partition.Replicas {
+			racks[load.racks[rep.Broker]] = true
+		}
+		if len(racks) != 3 {
+			t.Errorf("partition replicas should be on different racks! %v", partition.Replicas)
+		}
+	}
+
+	for _, name := range load.names() {
+		if load.count[name] != 3 {
+			t.Errorf("broker %s load %d invalid!", name, load.count[name])
+		}
+	}
+}
@@ -8,12 +8,27 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	DISPLAY_SEPARATOR = "------------------------------------------------"
 )
 
+const ctlCommands = `commands:
+  topic create <name> --partitions N --replicas R [policy]
+                                                   create topic with N partitions of R replicas.
+  topic config <name> [policy]                     change policy of topic, unset options keep old value.
+      policy: --retention D --retention-bytes B    delete old segments. 0 means unlimited.
+              --compact --tombstone-retention D    keep the latest message of each key.
+              --fsync always|interval|bytes|none   when brokers sync partition data to disk,
+              --fsync-interval D --fsync-bytes B   with interval or bytes of the policy.
+  topic delete <name>                              delete topic and its partition data.
+  reassign <partition> <broker1,broker2...>  move partition replicas to the broker list.
+  decommission <broker>                      move all replicas off the broker and wait until it is empty.
+  preferred [partition]                      move primaries back to the first listed replica.
+`
+
 var (
 	clustername string
 	commcfg     string
@@ -42,15 +57,28 @@ func flaginit() {
 
 func flagHelp() {
 	flag.Usage()
+	fmt.Fprint(os.Stderr, ctlCommands)
 	os.Exit(1)
 }
 
 func BrokerInfomation() {
 
-	brokerlist := BrokerServerGet(etcdconn)
-	topiclist := BrokerTopicGet(etcdconn)
-	partitionlist := BrokerPartitionGet(etcdconn)
-	publiccfg := BrokerPublicGet(etcdconn)
+	brokerlist, err := BrokerServerGet(etcdconn)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	topiclist, err := BrokerTopicGet(etcdconn)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	partitionlist, err := BrokerPartitionGet(etcdconn)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	publiccfg, err := BrokerPublicGet(etcdconn)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 
 	fmt.Println(DISPLAY_SEPARATOR)
 
@@ -170,39 +198,282 @@ func ParseConfig(param string) DataCommon {
 	return cfg
 }
 
-func BrokerPartitionScale(etcdconn *EtcdConn) error {
+func BrokerCommand(args []string) {
+	switch args[0] {
+	case "topic":
+		BrokerTopic(args[1:])
+	case "reassign":
+		BrokerReassign(args[1:])
+	case "decommission":
+		BrokerDecommission(args[1:])
+	case "preferred":
+		BrokerPreferred(args[1:])
+	default:
+		log.Println("unknown command!", args[0])
+		flagHelp()
+	}
+}
+
+/* create 和 config 共用的清理策略参数, 默认值为 policy 当前的值, 解析后调用返回的函数写回 */
+func topicPolicyFlags(fs *flag.FlagSet, policy *TopicPolicy) func() {
+	retention := fs.Duration("retention", time.Duration(policy.RetentionMs)*time.Millisecond,
+		"max age of messages, such as \"168h\". 0 means unlimited.")
+	fs.Int64Var(&policy.RetentionBytes, "retention-bytes", policy.RetentionBytes,
+		"max bytes of each partition. 0 means unlimited.")
+	fs.BoolVar(&policy.Compact, "compact", policy.Compact,
+		"keep only the latest message of each key.")
+	tombstone := fs.Duration("tombstone-retention", time.Duration(policy.TombstoneMs)*time.Millisecond,
+		"how long a message with empty body is kept after compaction. 0 means default.")
+	fs.StringVar(&policy.Fsync, "fsync", policy.Fsync,
+		"fsync policy: always, interval, bytes or none. empty means default.")
+	interval := fs.Duration("fsync-interval", time.Duration(policy.FsyncMs)*time.Millisecond,
+		"sync interval of the interval policy.")
+	fs.Int64Var(&policy.FsyncBytes, "fsync-bytes", policy.FsyncBytes,
+		"unsynced bytes threshold of the bytes policy.")
+
+	return func() {
+		policy.RetentionMs = int64(*retention / time.Millisecond)
+		policy.TombstoneMs = int64(*tombstone / time.Millisecond)
+		policy.FsyncMs = int64(*interval / time.Millisecond)
+
+		_, err := policy.SyncPolicy()
+		if err != nil {
+			log.Fatalln(err.Error(), policy.Fsync, *interval, policy.FsyncBytes)
+		}
+	}
+}
+
+func BrokerTopic(args []string) {
+	if len(args) < 2 {
+		flagHelp()
+	}
+	name := args[1]
+
+	switch args[0] {
+	case "create":
+		var partitions, replicas int
+		var policy TopicPolicy
+
+		fs := flag.NewFlagSet("topic create", flag.ExitOnError)
+		fs.IntVar(&partitions, "partitions", 1, "partition number of topic.")
+		fs.IntVar(&replicas, "replicas", 2, "replica number of each partition.")
+		parsed := topicPolicyFlags(fs, &policy)
+		fs.Parse(args[2:])
+		parsed()
+
+		topic, err := BrokerTopicAlloc(etcdconn, name, partitions, replicas, policy)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		log.Println("topic create success!", topic.Topic, topic.Partitions)
+
+	case "config":
+		topic, err := BrokerTopicFind(etcdconn, name)
+		if err != nil {
+			log.Fatalln("topic is not exist!", name)
+		}
+		policy := topic.TopicPolicy
+
+		fs := flag.NewFlagSet("topic config", flag.ExitOnError)
+		parsed := topicPolicyFlags(fs, &policy)
+		fs.Parse(args[2:])
+		parsed()
+
+		topic, err = BrokerTopicConfig(etcdconn, name, policy)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		log.Printf("topic config success! %s %+v\r\n", topic.Topic, topic.TopicPolicy)
+
+	case "delete":
+		if len(args) != 2 {
+			flagHelp()
+		}
+		err := BrokerTopicFree(etcdconn, name)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		log.Println("topic delete success! brokers will remove partition data.", name)
+
+	default:
+		log.Println("unknown topic command!", args[0])
+		flagHelp()
+	}
+}
+
+/* 迁移请求写入 etcd 后由控制器执行, 新副本同步完成后切换, 旧副本删除本地数据 */
+func BrokerReassign(args []string) {
+	if len(args) != 2 {
+		flagHelp()
+	}
+
+	reassign := DataReassign{PartitionID: args[0], Replicas: strings.Split(args[1], ",")}
+
+	partitions, err := BrokerPartitionGet(etcdconn)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	var exist bool
+	for _, v := range partitions {
+		if v.PartitionID == reassign.PartitionID {
+			exist = true
+		}
+	}
+	if exist == false {
+		log.Fatalln("partition is not exist!", reassign.PartitionID)
+	}
+
+	alive, err := brokerAlive(etcdconn)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	for i, broker := range reassign.Replicas {
+		if alive[broker] == false {
+			log.Fatalln("broker is not exist!", broker)
+		}
+		if stringsHas(reassign.Replicas[:i], broker) {
+			log.Fatalln("broker is duplicate!", broker)
+		}
+	}
+
+	err = BrokerReassignPut(etcdconn, reassign)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	log.Println("partition reassign submit success! controller will move data.", reassign.PartitionID, reassign.Replicas)
+}
+
+/* 为 broker 上的副本生成迁移请求, 替换的 broker 放在最后, 避免新副本成为主副本 */
+func decommissionReassign(partition *DataPartition, broker string, load *brokerLoad) (DataReassign, error) {
+	reassign := DataReassign{PartitionID: partition.PartitionID}
+
+	for _, rep := range partition.Replicas {
+		if rep.Broker != broker {
+			reassign.Replicas = append(reassign.Replicas, rep.Broker)
+		}
+	}
+
+	replace := load.pick(replicaBrokers(partition))
+	if replace == "" {
+		return reassign, errors.New("no broker to move replica of partition " + partition.PartitionID)
+	}
+	load.count[replace]++
+
+	reassign.Replicas = append(reassign.Replicas, replace)
+
+	return reassign, nil
+}
+
+/* 等待迁移请求完成, 并且 broker 上不再有副本 */
+func decommissionWait(broker string, partitions map[string]bool) {
+	for {
+		remain := 0
+		reassigns, err := BrokerReassignGet(etcdconn)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		list, err := BrokerPartitionGet(etcdconn)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
 
-	publiccfg := BrokerPublicGet(etcdconn)
-	brokerlist := BrokerServerGet(etcdconn)
-	partitionlist := BrokerPartitionGet(etcdconn)
+		for _, v := range list {
+			if partitions[v.PartitionID] == false {
+				continue
+			}
+			_, pending := reassigns[v.PartitionID]
+			if pending || stringsHas(replicaBrokers(&v), broker) {
+				remain++
+			}
+		}
 
-	num := publiccfg.PartitionNum - len(partitionlist)
+		if remain == 0 {
+			return
+		}
 
-	if num <= 0 {
-		return errors.New("No need to adjust.")
+		log.Printf("broker [%s] wait %d partitions to move...\r\n", broker, remain)
+		time.Sleep(time.Second)
 	}
+}
 
-	for i := 0; i < num; i++ {
+/* 先迁移主副本, 再迁移从副本, broker 上没有副本后才可以停止 */
+func BrokerDecommission(args []string) {
+	if len(args) != 1 {
+		flagHelp()
+	}
+	broker := args[0]
 
-		var partition DataPartition
+	err := BrokerDecommissionPut(etcdconn, broker)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 
-		partition.PartitionID = UUID(UUID64)
-		partition.Status = PART_S_FREE
-		partition.Replicas = make([]PartReplicas, publiccfg.ReplicasNum)
+	brokers, err := BrokerServerGet(etcdconn)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 
-		for j := 0; j < publiccfg.ReplicasNum; j++ {
-			partition.Replicas[j].Broker = brokerlist[(i+j)%len(brokerlist)].Broker
-			partition.Replicas[j].Role = PART_S_FOLLOW
+	available := make([]DataBroker, 0)
+	for _, v := range brokers {
+		if v.Broker != broker {
+			available = append(available, v)
 		}
-		partition.Replicas[0].Role = PART_S_PRIMARY
+	}
 
-		err := BrokerPartitionPut(etcdconn, partition)
+	for _, role := range []PART_S{PART_S_PRIMARY, PART_S_FOLLOW} {
+		partitions, err := BrokerPartitionGet(etcdconn)
 		if err != nil {
-			return err
+			log.Fatalln(err.Error())
+		}
+		load := newBrokerLoad(available, partitions)
+		moving := make(map[string]bool, 0)
+
+		for i := range partitions {
+			partition := &partitions[i]
+			for _, rep := range partition.Replicas {
+				if rep.Broker != broker || rep.Role != role {
+					continue
+				}
+
+				reassign, err := decommissionReassign(partition, broker, load)
+				if err != nil {
+					log.Fatalln(err.Error())
+				}
+
+				err = BrokerReassignPut(etcdconn, reassign)
+				if err != nil {
+					log.Fatalln(err.Error())
+				}
+				moving[partition.PartitionID] = true
+
+				log.Println("partition reassign submit!", reassign.PartitionID, reassign.Replicas)
+			}
 		}
+
+		decommissionWait(broker, moving)
 	}
 
-	return nil
+	log.Printf("broker [%s] is empty, it can be shut down now.\r\n", broker)
+}
+
+func BrokerPreferred(args []string) {
+	var partitionId string
+	if len(args) > 1 {
+		flagHelp()
+	}
+	if len(args) == 1 {
+		partitionId = args[0]
+	}
+
+	count, err := BrokerPreferredElect(etcdconn, partitionId)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	log.Printf("preferred primary elect %d partitions.\r\n", count)
 }
 
 func BrokerCtl() {
@@ -219,6 +490,11 @@ func BrokerCtl() {
 
 	etcdconn = etcd
 
+	if flag.NArg() > 0 {
+		BrokerCommand(flag.Args())
+		return
+	}
+
 	if infomation {
 		BrokerInfomation()
 		return
@@ -228,9 +504,9 @@ func BrokerCtl() {
 
 		cfg := ParseConfig(commcfg)
 
-		oldcfg := BrokerPublicGet(etcdconn)
-		if oldcfg == nil {
-			log.Fatalln("get old configure failed!")
+		oldcfg, err := BrokerPublicGet(etcdconn)
+		if err != nil {
+			log.Fatalln("get old configure failed!", err.Error())
 		}
 
 		if cfg.PartitionNum < oldcfg.PartitionNum ||
@@ -245,14 +521,7 @@ func BrokerCtl() {
 		if err != nil {
 			log.Fatalln(err.Error())
 		} else {
-			log.Println("update public configure success!", clustername, cfg)
-		}
-
-		err = BrokerPartitionScale(etcdconn)
-		if err != nil {
-			log.Fatalln(err.Error())
-		} else {
-			log.Println("partition scale success!", clustername, cfg)
+			log.Println("update public configure success! controller will place partitions.", clustername, cfg)
 		}
 
 		return
@@ -151,63 +151,187 @@ func (e *EtcdConn) Watch(ctx context.Context, key string) <-chan KvWatchRsq {
 
 	go func() {
 
-		select {
-		case wrsp := <-wch:
-			{
-				for _, event := range wrsp.Events {
-
-					switch event.Type {
-					case mvcc.PUT:
-						{
-							key = string(event.Kv.Key)
-							value = string(event.Kv.Value)
-							if event.Kv.Version == 1 {
-								act = EVENT_ADD
-							} else {
-								act = EVENT_UPDATE
-							}
-						}
+		for {
+			select {
+			case wrsp, ok := <-wch:
+				{
+					if ok == false {
+						watchrsq <- KvWatchRsq{Act: EVENT_EXIT}
+						return
+					}
 
-					case mvcc.DELETE:
-						{
-							if event.PrevKv == nil {
-								log.Println("prev kv is not exist!", key)
-								continue
+					for _, event := range wrsp.Events {
+
+						switch event.Type {
+						case mvcc.PUT:
+							{
+								key = string(event.Kv.Key)
+								value = string(event.Kv.Value)
+								if event.Kv.Version == 1 {
+									act = EVENT_ADD
+								} else {
+									act = EVENT_UPDATE
+								}
 							}
 
-							act = EVENT_DELETE
-							key = string(event.Kv.Key)
-							value = string(event.Kv.Value)
-							lease := event.PrevKv.Lease
+						case mvcc.DELETE:
+							{
+								key = string(event.Kv.Key)
 
-							if lease == 0 {
-								break
-							}
+								if event.PrevKv == nil {
+									log.Println("prev kv is not exist!", key)
+									continue
+								}
 
-							ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
-							resp, err := e.client.TimeToLive(ctx, clientv3.LeaseID(lease))
-							cancel()
+								act = EVENT_DELETE
+								value = string(event.PrevKv.Value)
+								lease := event.PrevKv.Lease
 
-							if err != nil {
-								break
-							}
+								if lease == 0 {
+									break
+								}
 
-							if resp.TTL == -1 {
-								act = EVENT_EXPIRE
+								ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+								resp, err := e.client.TimeToLive(ctx, clientv3.LeaseID(lease))
+								cancel()
+
+								if err != nil {
+									break
+								}
+
+								if resp.TTL == -1 {
+									act = EVENT_EXPIRE
+								}
 							}
+						default:
+							continue
 						}
-					default:
-						continue
-					}
 
-					watchrsq <- KvWatchRsq{Act: act, Key: key, Value: string(value)}
+						watchrsq <- KvWatchRsq{Act: act, Key: key, Value: string(value)}
+					}
 				}
+			case <-ctx.Done():
+				watchrsq <- KvWatchRsq{Act: EVENT_EXIT}
+				return
 			}
-		case <-ctx.Done():
-			watchrsq <- KvWatchRsq{Act: EVENT_EXIT}
-			return
 		}
 	}()
 
 	return watchrsq
 }
+
+func (e *EtcdConn) GetRevision(key string) ([]byte, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	resp, err := e.client.Get(ctx, key)
+	cancel()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrIsNone
+	}
+
+	return resp.Kvs[0].Value, resp.Kvs[0].ModRevision, nil
+}
+
+/* modrev 为 0 表示 key 不存在时才写入 */
+func (e *EtcdConn) CompareAndPut(key string, value []byte, modrev int64) (bool, error) {
+	cmp := clientv3.Compare(clientv3.ModRevision(key), "=", modrev)
+	put := clientv3.OpPut(key, string(value))
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	resp, err := e.client.Txn(ctx).If(cmp).Then(put).Commit()
+	cancel()
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+/* key 不存在时以租约写入, 成功时返回 key 的创建版本 */
+func (e *EtcdConn) CreateLease(key string, value []byte, lease clientv3.LeaseID) (int64, bool, error) {
+	cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	put := clientv3.OpPut(key, string(value), clientv3.WithLease(lease))
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	resp, err := e.client.Txn(ctx).If(cmp).Then(put).Commit()
+	cancel()
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.Succeeded == false {
+		return 0, false, nil
+	}
+
+	return resp.Header.Revision, true, nil
+}
+
+/* guard 的创建版本仍然是 createrev 时才写入 key, guard 被删除或者重新创建后写入失败 */
+func (e *EtcdConn) GuardPut(guard string, createrev int64, key string, value []byte) (bool, error) {
+	cmp := clientv3.Compare(clientv3.CreateRevision(guard), "=", createrev)
+	put := clientv3.OpPut(key, string(value))
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	resp, err := e.client.Txn(ctx).If(cmp).Then(put).Commit()
+	cancel()
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+/* 创建版本仍然是 createrev 时才删除 key */
+func (e *EtcdConn) GuardDelete(key string, createrev int64) (bool, error) {
+	cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", createrev)
+	del := clientv3.OpDelete(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	resp, err := e.client.Txn(ctx).If(cmp).Then(del).Commit()
+	cancel()
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+func (e *EtcdConn) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	_, err := e.client.Delete(ctx, key)
+	cancel()
+	return err
+}
+
+func (e *EtcdConn) Grant(ttl int64) (clientv3.LeaseID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	resp, err := e.client.Grant(ctx, ttl)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+func (e *EtcdConn) Revoke(lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	_, err := e.client.Revoke(ctx, lease)
+	cancel()
+	return err
+}
+
+func (e *EtcdConn) KeepAliveOnce(lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	_, err := e.client.KeepAliveOnce(ctx, lease)
+	cancel()
+	return err
+}
+
+func (e *EtcdConn) PutLease(key string, value []byte, lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	_, err := e.client.Put(ctx, key, string(value), clientv3.WithLease(lease))
+	cancel()
+	return err
+}
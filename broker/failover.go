@@ -0,0 +1,179 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+/*
+ * broker 租约过期后, 控制器把它上面的主副本切换到存活的同步从副本.
+ * 切换只修改副本的角色, 不改变副本顺序, broker 恢复后再切换回首选副本.
+ * 分区记录以 CAS 方式修改, 与其他修改同时发生时重新读取记录后再判断.
+ */
+
+/* 只选择同步副本集合中并且存活的从副本, 没有可选的副本时保持原样 */
+func partitionFailover(partition *DataPartition, broker string, alive map[string]bool) bool {
+	isr := make([]string, 0, len(partition.ISR))
+	for _, v := range partition.ISR {
+		if v != broker {
+			isr = append(isr, v)
+		}
+	}
+
+	primary := -1
+	for i, rep := range partition.Replicas {
+		if rep.Role == PART_S_PRIMARY {
+			primary = i
+		}
+	}
+
+	if primary == -1 || partition.Replicas[primary].Broker != broker {
+		if len(isr) == len(partition.ISR) {
+			return false
+		}
+		partition.ISR = isr
+		return true
+	}
+
+	for i, rep := range partition.Replicas {
+		if rep.Broker == broker || alive[rep.Broker] == false || stringsHas(isr, rep.Broker) == false {
+			continue
+		}
+
+		partition.Replicas[primary].Role = PART_S_FOLLOW
+		partition.Replicas[i].Role = PART_S_PRIMARY
+		partition.ISR = isr
+
+		log.Println("partition failover!", partition.PartitionID, broker, "->", rep.Broker)
+		return true
+	}
+
+	log.Println("partition has no in-sync replica to failover!", partition.PartitionID, broker)
+	return false
+}
+
+func brokerAlive(etcdconn *EtcdConn) (map[string]bool, error) {
+	brokers, err := BrokerServerGet(etcdconn)
+	if err != nil {
+		return nil, err
+	}
+
+	alive := make(map[string]bool, 0)
+	for _, v := range brokers {
+		alive[v.Broker] = true
+	}
+	return alive, nil
+}
+
+func BrokerFailover(etcdconn *EtcdConn, broker string) {
+	alive, err := brokerAlive(etcdconn)
+	if err != nil {
+		log.Println("failover get broker failed!", broker, err.Error())
+		return
+	}
+
+	if alive[broker] {
+		return
+	}
+
+	partitions, err := BrokerPartitionGet(etcdconn)
+	if err != nil {
+		log.Println("failover get partition failed!", broker, err.Error())
+		return
+	}
+
+	for _, v := range partitions {
+		err := BrokerPartitionUpdate(etcdconn, v.PartitionID, func(partition *DataPartition) bool {
+			return partitionFailover(partition, broker, alive)
+		})
+		if err != nil {
+			log.Println("partition failover failed!", v.PartitionID, err.Error())
+		}
+	}
+}
+
+func BrokerFailoverWatch(ctx context.Context, etcdconn *EtcdConn) {
+	kvlist := etcdconn.Watch(ctx, KEY_BROKER)
+
+	go func() {
+		for event := range kvlist {
+			switch event.Act {
+			case EVENT_EXPIRE:
+				var brk DataBroker
+				err := json.Unmarshal([]byte(event.Value), &brk)
+				if err != nil || brk.Broker == "" {
+					brk.Broker = strings.TrimPrefix(event.Key, KEY_BROKER)
+				}
+
+				log.Println("broker lease expire!", brk.Broker)
+				BrokerFailover(etcdconn, brk.Broker)
+
+			case EVENT_EXIT:
+				return
+			}
+		}
+	}()
+}
+
+/* 第一个副本为首选主副本, 存活并且在同步副本集合中时切换回来 */
+func partitionPreferred(partition *DataPartition, alive map[string]bool) bool {
+	if len(partition.Replicas) == 0 {
+		return false
+	}
+
+	preferred := &partition.Replicas[0]
+	if preferred.Role == PART_S_PRIMARY {
+		return false
+	}
+	if alive[preferred.Broker] == false || stringsHas(partition.ISR, preferred.Broker) == false {
+		return false
+	}
+
+	for i := range partition.Replicas {
+		rep := &partition.Replicas[i]
+		if rep.Role == PART_S_PRIMARY {
+			log.Println("partition preferred primary!", partition.PartitionID, rep.Broker, "->", preferred.Broker)
+			rep.Role = PART_S_FOLLOW
+		}
+	}
+	preferred.Role = PART_S_PRIMARY
+
+	return true
+}
+
+/* 把主副本切换回首选副本, partitionId 为空时处理所有分区, 返回切换的分区数量 */
+func BrokerPreferredElect(etcdconn *EtcdConn, partitionId string) (int, error) {
+	alive, err := brokerAlive(etcdconn)
+	if err != nil {
+		return 0, err
+	}
+
+	partitions, err := BrokerPartitionGet(etcdconn)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, v := range partitions {
+		if partitionId != "" && v.PartitionID != partitionId {
+			continue
+		}
+
+		var changed bool
+		err := BrokerPartitionUpdate(etcdconn, v.PartitionID, func(partition *DataPartition) bool {
+			changed = partitionPreferred(partition, alive)
+			return changed
+		})
+		if err != nil {
+			log.Println("partition preferred elect failed!", v.PartitionID, err.Error())
+			continue
+		}
+		if changed {
+			count++
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestFailover01(t *testing.T) {
+	partition := DataPartition{
+		PartitionID: "0x123",
+		Replicas: []PartReplicas{
+			{Broker: "broker1", Role: PART_S_PRIMARY},
+			{Broker: "broker2", Role: PART_S_FOLLOW},
+			{Broker: "broker3", Role: PART_S_FOLLOW},
+		},
+		ISR: []string{"broker1", "broker3"},
+	}
+
+	alive := map[string]bool{"broker2": true, "broker3": true}
+
+	if partitionFailover(&partition, "broker1", alive) == false {
+		t.Errorf("partition should failover!")
+		return
+	}
+
+	if partition.Replicas[0].Role != PART_S_FOLLOW || partition.Replicas[2].Role != PART_S_PRIMARY {
+		t.Errorf("partition failover to invalid replica! %v", partition.Replicas)
+	}
+
+	if len(partition.ISR) != 1 || partition.ISR[0] != "broker3" {
+		t.Errorf("partition isr invalid! %v", partition.ISR)
+	}
+
+	if partitionFailover(&partition, "broker1", alive) {
+		t.Errorf("partition should not change again!")
+	}
+}
+
+func TestFailover02(t *testing.T) {
+	partition := DataPartition{
+		PartitionID: "0x456",
+		Replicas: []PartReplicas{
+			{Broker: "broker1", Role: PART_S_PRIMARY},
+			{Broker: "broker2", Role: PART_S_FOLLOW},
+		},
+		ISR: []string{"broker1"},
+	}
+
+	alive := map[string]bool{"broker2": true}
+
+	if partitionFailover(&partition, "broker1", alive) {
+		t.Errorf("out of sync replica should not be primary!")
+	}
+
+	if partition.Replicas[0].Role != PART_S_PRIMARY || len(partition.ISR) != 1 {
+		t.Errorf("partition should not change! %v", partition)
+	}
+}
+
+func TestFailover03(t *testing.T) {
+	partition := DataPartition{
+		PartitionID: "0x789",
+		Replicas: []PartReplicas{
+			{Broker: "broker1", Role: PART_S_FOLLOW},
+			{Broker: "broker2", Role: PART_S_PRIMARY},
+		},
+		ISR: []string{"broker2"},
+	}
+
+	alive := map[string]bool{"broker1": true, "broker2": true}
+
+	if partitionPreferred(&partition, alive) {
+		t.Errorf("out of sync replica should not be primary!")
+	}
+
+	partition.ISR = append(partition.ISR, "broker1")
+
+	if partitionPreferred(&partition, alive) == false {
+		t.Errorf("preferred replica should be primary!")
+		return
+	}
+
+	if partition.Replicas[0].Role != PART_S_PRIMARY || partition.Replicas[1].Role != PART_S_FOLLOW {
+		t.Errorf("partition preferred invalid! %v", partition.Replicas)
+	}
+
+	if partitionPreferred(&partition, alive) {
+		t.Errorf("partition should not change again!")
+	}
+}
@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+type SYNC_P int /* 落盘策略类型 */
+
+const (
+	SYNC_P_BYTES    SYNC_P = iota /* 未同步的数据超过 Bytes 时同步 */
+	SYNC_P_ALWAYS                 /* 每次写入都同步, 并发的写入共用一次同步 */
+	SYNC_P_INTERVAL               /* 每隔 Interval 同步一次 */
+	SYNC_P_NONE                   /* 由操作系统决定何时写回 */
+)
+
+var ErrSyncPolicy = errors.New("fsync policy is invalid!")
+
+type SyncPolicy struct {
+	Mode     SYNC_P
+	Interval time.Duration
+	Bytes    int64
+}
+
+/* topic 没有配置落盘策略时使用 */
+var SYNC_DEFAULT = SyncPolicy{Mode: SYNC_P_BYTES, Bytes: int64(SEGMENT_SYNCSIZE)}
+
+var syncModes = map[string]SYNC_P{
+	"bytes":    SYNC_P_BYTES,
+	"always":   SYNC_P_ALWAYS,
+	"interval": SYNC_P_INTERVAL,
+	"none":     SYNC_P_NONE,
+}
+
+/* mode 为空时使用默认策略 */
+func NewSyncPolicy(mode string, interval time.Duration, bytes int64) (SyncPolicy, error) {
+	if mode == "" {
+		return SYNC_DEFAULT, nil
+	}
+
+	m, b := syncModes[mode]
+	if b == false {
+		return SYNC_DEFAULT, ErrSyncPolicy
+	}
+
+	policy := SyncPolicy{Mode: m}
+	switch m {
+	case SYNC_P_INTERVAL:
+		if interval <= 0 {
+			return SYNC_DEFAULT, ErrSyncPolicy
+		}
+		policy.Interval = interval
+	case SYNC_P_BYTES:
+		if bytes <= 0 {
+			return SYNC_DEFAULT, ErrSyncPolicy
+		}
+		policy.Bytes = bytes
+	}
+
+	return policy, nil
+}
+
+func (t TopicPolicy) SyncPolicy() (SyncPolicy, error) {
+	return NewSyncPolicy(t.Fsync, time.Duration(t.FsyncMs)*time.Millisecond, t.FsyncBytes)
+}
+
+func (part *Partition) SetSyncPolicy(policy SyncPolicy) {
+	part.Lock()
+	defer part.Unlock()
+
+	if part.deleted || part.policy == policy {
+		return
+	}
+
+	log.Printf("partition fsync policy change! %s %+v -> %+v\r\n", part.ID, part.policy, policy)
+
+	part.stopSyncLoop()
+	part.policy = policy
+
+	if policy.Mode == SYNC_P_INTERVAL {
+		part.syncstop = make(chan struct{})
+		go part.syncLoop(policy.Interval, part.syncstop)
+	}
+}
+
+func (part *Partition) stopSyncLoop() {
+	if part.syncstop != nil {
+		close(part.syncstop)
+		part.syncstop = nil
+	}
+}
+
+func (part *Partition) syncLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			part.Flush(part.CurOffset())
+		}
+	}
+}
+
+/* 写入 offset 之后按落盘策略决定是否需要同步, 需要时返回前等待同步完成 */
+func (part *Partition) Commit(offset uint64) {
+	part.RLock()
+	policy, unsynced := part.policy, part.unsynced
+	part.RUnlock()
+
+	switch policy.Mode {
+	case SYNC_P_ALWAYS:
+		part.Flush(offset)
+	case SYNC_P_BYTES:
+		if unsynced >= policy.Bytes {
+			part.Flush(offset)
+		}
+	}
+}
+
+/*
+ * 组提交: 同一时间只有一个协程执行同步, 同步期间其他协程可以继续写入.
+ * 等待的协程拿到锁后, 如果之前的同步已经覆盖了 offset 就直接返回, 多个写入共用一次同步.
+ * 段切换时旧段已经同步过, 这里只需要同步最后一个段.
+ */
+func (part *Partition) Flush(offset uint64) {
+	part.syncmu.Lock()
+	defer part.syncmu.Unlock()
+
+	part.RLock()
+	if part.deleted || part.synced >= offset {
+		part.RUnlock()
+		return
+	}
+	target, unsynced := part.Offset, part.unsynced
+	files := part.seglist.Last().files()
+	part.RUnlock()
+
+	for _, fd := range files {
+		syncFile(fd)
+	}
+
+	part.Lock()
+	if target > part.synced {
+		part.synced = target
+	}
+	part.unsynced -= unsynced
+	if part.unsynced < 0 {
+		part.unsynced = 0
+	}
+	part.Unlock()
+}
+
+/* 段在同步期间可能被截断或者删除, 这时不需要再同步 */
+func syncFile(fd *os.File) {
+	err := fd.Sync()
+	if err != nil && errors.Is(err, os.ErrClosed) == false {
+		log.Fatalln("fsync failed!", fd.Name(), err.Error())
+	}
+}
+
+func (part *Partition) SyncedOffset() uint64 {
+	part.RLock()
+	defer part.RUnlock()
+
+	return part.synced
+}
@@ -0,0 +1,369 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+/*
+ * 消费组: 成员以租约注册在 KEY_GROUP/<group>/<consumer> 下, 所有成员监听该目录,
+ * 成员变化(加入/退出/租约过期)后各自按相同的规则重新计算分配结果, 只消费分给自己的分区.
+ *
+ * 分到的分区要先在 KEY_GROUPOWNER/<group>/<partition> 认领, 原来的成员提交偏移并释放之后
+ * 才能认领成功, 成员退出或者租约过期时认领记录随租约删除. 认领记录的创建版本作为分区的代数,
+ * 偏移记录在 KEY_GROUPOFFSET/<group>/<partition>, 提交时比较代数, 分区已经被别人认领时提交失败.
+ */
+
+const (
+	ASSIGN_RANGE      = "range"
+	ASSIGN_ROUNDROBIN = "roundrobin"
+)
+
+var (
+	ErrUnknownStrategy = errors.New("assign strategy is not supported!")
+	ErrGroupFenced     = errors.New("partition is claimed by other group member!")
+)
+
+/* 输入成员列表和主题对应的分区列表, 返回每个成员分到的分区 */
+type AssignFunc func(members []DataGroupMember, partitions map[string][]string) map[string][]string
+
+var assignStrategies = map[string]AssignFunc{
+	ASSIGN_RANGE:      AssignRange,
+	ASSIGN_ROUNDROBIN: AssignRoundRobin,
+}
+
+func subscribed(member DataGroupMember, topic string) bool {
+	for _, v := range member.Topics {
+		if v == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedTopics(partitions map[string][]string) []string {
+	topics := make([]string, 0, len(partitions))
+	for topic := range partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func sortedMembers(members []DataGroupMember) []DataGroupMember {
+	list := append([]DataGroupMember{}, members...)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ConsumerID < list[j].ConsumerID
+	})
+	return list
+}
+
+/* 每个主题的分区按顺序切成连续的几段, 前面的成员多分一个 */
+func AssignRange(members []DataGroupMember, partitions map[string][]string) map[string][]string {
+	result := make(map[string][]string, len(members))
+	members = sortedMembers(members)
+
+	for _, topic := range sortedTopics(partitions) {
+		list := make([]string, 0)
+		for _, m := range members {
+			if subscribed(m, topic) {
+				list = append(list, m.ConsumerID)
+			}
+		}
+		if len(list) == 0 {
+			continue
+		}
+
+		parts := append([]string{}, partitions[topic]...)
+		sort.Strings(parts)
+
+		num := len(parts) / len(list)
+		extra := len(parts) % len(list)
+
+		start := 0
+		for i, id := range list {
+			cnt := num
+			if i < extra {
+				cnt++
+			}
+			result[id] = append(result[id], parts[start:start+cnt]...)
+			start += cnt
+		}
+	}
+
+	return result
+}
+
+/* 所有主题的分区排成一列, 依次轮流分给订阅了该主题的成员 */
+func AssignRoundRobin(members []DataGroupMember, partitions map[string][]string) map[string][]string {
+	result := make(map[string][]string, len(members))
+	members = sortedMembers(members)
+	if len(members) == 0 {
+		return result
+	}
+
+	next := 0
+	for _, topic := range sortedTopics(partitions) {
+		parts := append([]string{}, partitions[topic]...)
+		sort.Strings(parts)
+
+		for _, part := range parts {
+			for i := 0; i < len(members); i++ {
+				m := members[(next+i)%len(members)]
+				if subscribed(m, topic) {
+					result[m.ConsumerID] = append(result[m.ConsumerID], part)
+					next = (next + i + 1) % len(members)
+					break
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+type consumerGroup struct {
+	name     string
+	member   DataGroupMember
+	etcdconn *EtcdConn
+	lease    clientv3.LeaseID
+	changed  int32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func groupKey(group string) string {
+	return KEY_GROUP + group + "/"
+}
+
+func newConsumerGroup(etcdconn *EtcdConn, name string, member DataGroupMember) (*consumerGroup, error) {
+	_, b := assignStrategies[member.Strategy]
+	if b == false {
+		return nil, ErrUnknownStrategy
+	}
+
+	g := new(consumerGroup)
+	g.name = name
+	g.member = member
+	g.etcdconn = etcdconn
+	g.changed = 1
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+
+	err := g.register()
+	if err != nil {
+		return nil, err
+	}
+
+	go g.keepalive()
+	go g.watch()
+
+	return g, nil
+}
+
+func (g *consumerGroup) register() error {
+	value, err := json.Marshal(g.member)
+	if err != nil {
+		return err
+	}
+
+	lease, err := g.etcdconn.Grant(int64(defaultTTL))
+	if err != nil {
+		return err
+	}
+
+	err = g.etcdconn.PutLease(groupKey(g.name)+g.member.ConsumerID, value, lease)
+	if err != nil {
+		return err
+	}
+
+	g.lease = lease
+	log.Println("consumer [" + g.member.ConsumerID + "] join group [" + g.name + "] success!")
+	return nil
+}
+
+/* 心跳失败超过次数后认为租约已经失效, 重新注册 */
+func (g *consumerGroup) keepalive() {
+	var trycnt int
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-time.After(time.Duration(defaultTTL) * time.Second / defaultTimes):
+		}
+
+		err := g.etcdconn.KeepAliveOnce(g.lease)
+		if err == nil {
+			trycnt = 0
+			continue
+		}
+
+		trycnt++
+		if trycnt <= defaultTryTimes {
+			continue
+		}
+
+		log.Println("consumer group heartbeat fail!", g.name, err.Error())
+
+		err = g.register()
+		if err == nil {
+			trycnt = 0
+			atomic.StoreInt32(&g.changed, 1)
+		}
+	}
+}
+
+func (g *consumerGroup) watch() {
+	for g.ctx.Err() == nil {
+		kvlist := g.etcdconn.Watch(g.ctx, groupKey(g.name))
+		for event := range kvlist {
+			atomic.StoreInt32(&g.changed, 1)
+			if event.Act == EVENT_EXIT {
+				break
+			}
+		}
+
+		select {
+		case <-g.ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (g *consumerGroup) leave() {
+	g.cancel()
+
+	err := g.etcdconn.Revoke(g.lease)
+	if err != nil {
+		log.Println("consumer group leave failed!", g.name, err.Error())
+	}
+}
+
+func groupOwnerKey(group string, partitionId string) string {
+	return KEY_GROUPOWNER + group + "/" + partitionId
+}
+
+func groupOffsetKey(group string, partitionId string) string {
+	return KEY_GROUPOFFSET + group + "/" + partitionId
+}
+
+/* 认领分区, 返回分区的代数; 分区还没有被原来的成员释放时返回 0 */
+func (g *consumerGroup) claim(partitionId string) (int64, error) {
+	generation, succ, err := g.etcdconn.CreateLease(groupOwnerKey(g.name, partitionId), []byte(g.member.ConsumerID), g.lease)
+	if err != nil || succ == false {
+		return 0, err
+	}
+	return generation, nil
+}
+
+/* 只删除自己的认领记录, 代数不同说明已经被别人认领 */
+func (g *consumerGroup) release(partitionId string, generation int64) error {
+	_, err := g.etcdconn.GuardDelete(groupOwnerKey(g.name, partitionId), generation)
+	return err
+}
+
+/* 读取消费组在分区上提交的偏移, 没有提交过时返回 nil */
+func (g *consumerGroup) offset(partitionId string) (*DataSubscribe, error) {
+	value, err := g.etcdconn.Get(groupOffsetKey(g.name, partitionId))
+	if err != nil {
+		if err == ErrIsNone {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sub := new(DataSubscribe)
+	err = json.Unmarshal(value, sub)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (g *consumerGroup) commit(sub DataSubscribe, generation int64) error {
+	value, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	succ, err := g.etcdconn.GuardPut(groupOwnerKey(g.name, sub.PartitionID), generation,
+		groupOffsetKey(g.name, sub.PartitionID), value)
+	if err != nil {
+		return err
+	}
+	if succ == false {
+		return ErrGroupFenced
+	}
+	return nil
+}
+
+func (g *consumerGroup) rebalanced() bool {
+	return atomic.SwapInt32(&g.changed, 0) == 1
+}
+
+func (g *consumerGroup) members() ([]DataGroupMember, error) {
+	members := make([]DataGroupMember, 0)
+
+	keylist, err := g.etcdconn.GetAll(groupKey(g.name))
+	if err != nil {
+		if err == ErrIsNone {
+			return members, nil
+		}
+		return nil, err
+	}
+
+	for _, v := range keylist {
+		var member DataGroupMember
+		err := json.Unmarshal([]byte(v.Value), &member)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+/* 所有成员使用 id 最小的成员的分配策略, 保证计算结果一致 */
+func (g *consumerGroup) assign(lookup func(topic string) ([]string, error)) ([]string, error) {
+	members, err := g.members()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) == 0 {
+		return []string{}, nil
+	}
+
+	partitions := make(map[string][]string, 0)
+	for _, m := range members {
+		for _, topic := range m.Topics {
+			_, b := partitions[topic]
+			if b {
+				continue
+			}
+			list, err := lookup(topic)
+			if err != nil {
+				log.Println("consumer group lookup topic failed!", topic, err.Error())
+				continue
+			}
+			partitions[topic] = list
+		}
+	}
+
+	strategy, b := assignStrategies[sortedMembers(members)[0].Strategy]
+	if b == false {
+		strategy = assignStrategies[g.member.Strategy]
+	}
+
+	return strategy(members, partitions)[g.member.ConsumerID], nil
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAssign01(t *testing.T) {
+	members := []DataGroupMember{
+		{ConsumerID: "c2", Topics: []string{"t1", "t2"}},
+		{ConsumerID: "c1", Topics: []string{"t1", "t2"}},
+		{ConsumerID: "c3", Topics: []string{"t1"}},
+	}
+
+	partitions := map[string][]string{
+		"t1": {"p1", "p2", "p3", "p4"},
+		"t2": {"p5", "p6", "p7"},
+	}
+
+	result := AssignRange(members, partitions)
+
+	expect := map[string][]string{
+		"c1": {"p1", "p2", "p5", "p6"},
+		"c2": {"p3", "p7"},
+		"c3": {"p4"},
+	}
+
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("range assign invalid! %v", result)
+	}
+}
+
+func TestAssign02(t *testing.T) {
+	members := []DataGroupMember{
+		{ConsumerID: "c2", Topics: []string{"t1", "t2"}},
+		{ConsumerID: "c1", Topics: []string{"t1", "t2"}},
+		{ConsumerID: "c3", Topics: []string{"t1"}},
+	}
+
+	partitions := map[string][]string{
+		"t1": {"p1", "p2", "p3", "p4"},
+		"t2": {"p5", "p6", "p7"},
+	}
+
+	result := AssignRoundRobin(members, partitions)
+
+	expect := map[string][]string{
+		"c1": {"p1", "p4", "p6"},
+		"c2": {"p2", "p5", "p7"},
+		"c3": {"p3"},
+	}
+
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("roundrobin assign invalid! %v", result)
+	}
+
+	total := 0
+	for _, v := range result {
+		total += len(v)
+	}
+	if total != 7 {
+		t.Errorf("roundrobin assign lost partition! %v", result)
+	}
+}
+
+func TestGroupKey01(t *testing.T) {
+	/* 消费组的偏移和认领记录不能落在同名单独消费者的 key 和成员监听的目录下 */
+	keys := []string{groupOffsetKey("test", "0x1"), groupOwnerKey("test", "0x1")}
+	for _, key := range keys {
+		if strings.HasPrefix(key, KEY_CONSUMER) || strings.HasPrefix(key, groupKey("test")) {
+			t.Errorf("group key %s is conflict!", key)
+		}
+	}
+	if groupOffsetKey("test", "0x1") == groupOwnerKey("test", "0x1") {
+		t.Errorf("group offset and owner key is same!")
+	}
+}
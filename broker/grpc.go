@@ -0,0 +1,799 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+ * broker.proto 中定义的 gRPC 服务, 消息按 protobuf 编码规则直接编解码,
+ * 非 Go 语言的客户端可以使用 broker.proto 生成的代码访问.
+ */
+
+const (
+	GRPC_SERVICE    = "broker.Broker"
+	GRPC_FETCHBATCH = 100
+	GRPC_FETCHWAIT  = 100 * time.Millisecond
+)
+
+var (
+	ErrNotPbMessage = errors.New("message is not protobuf message!")
+)
+
+type pbMessage interface {
+	marshalPB() []byte
+	unmarshalPB(b []byte) error
+}
+
+type pbCodec struct{}
+
+func (pbCodec) Marshal(v interface{}) ([]byte, error) {
+	m, b := v.(pbMessage)
+	if b == false {
+		return nil, ErrNotPbMessage
+	}
+	return m.marshalPB(), nil
+}
+
+func (pbCodec) Unmarshal(data []byte, v interface{}) error {
+	m, b := v.(pbMessage)
+	if b == false {
+		return ErrNotPbMessage
+	}
+	return m.unmarshalPB(data)
+}
+
+func (pbCodec) Name() string {
+	return "proto"
+}
+
+type pbField struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+/* 遍历报文中的字段, 只关心 varint 和 bytes 两种类型, 其他类型跳过 */
+func pbFields(b []byte, fn func(f *pbField)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := &pbField{num: num}
+
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			f = nil
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if f != nil {
+			fn(f)
+		}
+	}
+	return nil
+}
+
+/* repeated uint64 兼容 packed 和非 packed 两种编码 */
+func pbUint64s(f *pbField, list []uint64) []uint64 {
+	if f.bytes == nil {
+		return append(list, f.varint)
+	}
+	b := f.bytes
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			break
+		}
+		list = append(list, v)
+		b = b[n:]
+	}
+	return list
+}
+
+func pbAppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func pbAppendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func pbAppendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func pbBool(v bool) uint64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+/* Record 消息, headers 按 map<string, string> 编码 */
+func pbAppendRecord(b []byte, num protowire.Number, v Message) []byte {
+	rec := pbAppendVarint(nil, 1, v.Offset)
+	rec = pbAppendBytes(rec, 2, v.Body)
+	if len(v.Key) > 0 {
+		rec = pbAppendBytes(rec, 3, v.Key)
+	}
+	rec = pbAppendVarint(rec, 4, uint64(v.Timestamp))
+	for name, value := range v.Headers {
+		entry := pbAppendString(nil, 1, name)
+		entry = pbAppendString(entry, 2, value)
+		rec = pbAppendBytes(rec, 5, entry)
+	}
+	return pbAppendBytes(b, num, rec)
+}
+
+func pbRecord(b []byte) (Message, error) {
+	var rec Message
+	err := pbFields(b, func(f *pbField) {
+		switch f.num {
+		case 1:
+			rec.Offset = f.varint
+		case 2:
+			rec.Body = append([]byte{}, f.bytes...)
+		case 3:
+			rec.Key = append([]byte{}, f.bytes...)
+		case 4:
+			rec.Timestamp = int64(f.varint)
+		case 5:
+			var name, value string
+			pbFields(f.bytes, func(f *pbField) {
+				switch f.num {
+				case 1:
+					name = string(f.bytes)
+				case 2:
+					value = string(f.bytes)
+				}
+			})
+			if rec.Headers == nil {
+				rec.Headers = make(map[string]string, 0)
+			}
+			rec.Headers[name] = value
+		}
+	})
+	return rec, err
+}
+
+/* Records 不为空时使用 Records, 可以携带 key、创建时间和 headers */
+type pbProduceReq struct {
+	PartitionID string
+	Messages    [][]byte
+	Acks        ACKS
+	TimeoutMs   uint32
+	Records     []Message
+}
+
+func (m *pbProduceReq) marshalPB() []byte {
+	b := pbAppendString(nil, 1, m.PartitionID)
+	for _, v := range m.Messages {
+		b = pbAppendBytes(b, 2, v)
+	}
+	b = pbAppendVarint(b, 3, uint64(int64(m.Acks)))
+	b = pbAppendVarint(b, 4, uint64(m.TimeoutMs))
+	for _, v := range m.Records {
+		b = pbAppendRecord(b, 5, v)
+	}
+	return b
+}
+
+func (m *pbProduceReq) unmarshalPB(b []byte) error {
+	var err error
+	perr := pbFields(b, func(f *pbField) {
+		switch f.num {
+		case 1:
+			m.PartitionID = string(f.bytes)
+		case 2:
+			m.Messages = append(m.Messages, append([]byte{}, f.bytes...))
+		case 3:
+			m.Acks = ACKS(int32(f.varint))
+		case 4:
+			m.TimeoutMs = uint32(f.varint)
+		case 5:
+			var rec Message
+			rec, err = pbRecord(f.bytes)
+			m.Records = append(m.Records, rec)
+		}
+	})
+	if perr != nil {
+		return perr
+	}
+	return err
+}
+
+type pbProduceRsp struct {
+	Offsets []uint64
+}
+
+func (m *pbProduceRsp) marshalPB() []byte {
+	if len(m.Offsets) == 0 {
+		return nil
+	}
+	var packed []byte
+	for _, v := range m.Offsets {
+		packed = protowire.AppendVarint(packed, v)
+	}
+	return pbAppendBytes(nil, 1, packed)
+}
+
+func (m *pbProduceRsp) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {
+		if f.num == 1 {
+			m.Offsets = pbUint64s(f, m.Offsets)
+		}
+	})
+}
+
+type pbFetchReq struct {
+	PartitionID string
+	Offset      uint64
+	MaxCount    uint32
+	Follow      bool
+}
+
+func (m *pbFetchReq) marshalPB() []byte {
+	b := pbAppendString(nil, 1, m.PartitionID)
+	b = pbAppendVarint(b, 2, m.Offset)
+	b = pbAppendVarint(b, 3, uint64(m.MaxCount))
+	b = pbAppendVarint(b, 4, pbBool(m.Follow))
+	return b
+}
+
+func (m *pbFetchReq) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {
+		switch f.num {
+		case 1:
+			m.PartitionID = string(f.bytes)
+		case 2:
+			m.Offset = f.varint
+		case 3:
+			m.MaxCount = uint32(f.varint)
+		case 4:
+			m.Follow = f.varint != 0
+		}
+	})
+}
+
+type pbFetchRsp struct {
+	Records []Message
+}
+
+func (m *pbFetchRsp) marshalPB() []byte {
+	var b []byte
+	for _, v := range m.Records {
+		b = pbAppendRecord(b, 1, v)
+	}
+	return b
+}
+
+func (m *pbFetchRsp) unmarshalPB(b []byte) error {
+	var err error
+	perr := pbFields(b, func(f *pbField) {
+		if f.num != 1 {
+			return
+		}
+		var rec Message
+		rec, err = pbRecord(f.bytes)
+		m.Records = append(m.Records, rec)
+	})
+	if perr != nil {
+		return perr
+	}
+	return err
+}
+
+type pbListPartitionsReq struct {
+	Topic string
+}
+
+func (m *pbListPartitionsReq) marshalPB() []byte {
+	return pbAppendString(nil, 1, m.Topic)
+}
+
+func (m *pbListPartitionsReq) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {
+		if f.num == 1 {
+			m.Topic = string(f.bytes)
+		}
+	})
+}
+
+type pbReplica struct {
+	Broker   string
+	Endpoint string
+	Grpc     string
+	Role     PART_S
+}
+
+type pbPartition struct {
+	PartitionID string
+	Topic       string
+	Status      PART_S
+	Replicas    []pbReplica
+}
+
+type pbListPartitionsRsp struct {
+	Partitions []pbPartition
+}
+
+func (m *pbListPartitionsRsp) marshalPB() []byte {
+	var b []byte
+	for _, v := range m.Partitions {
+		part := pbAppendString(nil, 1, v.PartitionID)
+		part = pbAppendString(part, 2, v.Topic)
+		part = pbAppendVarint(part, 3, uint64(v.Status))
+		for _, rep := range v.Replicas {
+			r := pbAppendString(nil, 1, rep.Broker)
+			r = pbAppendString(r, 2, rep.Endpoint)
+			r = pbAppendString(r, 3, rep.Grpc)
+			r = pbAppendVarint(r, 4, uint64(rep.Role))
+			part = pbAppendBytes(part, 4, r)
+		}
+		b = pbAppendBytes(b, 1, part)
+	}
+	return b
+}
+
+func (m *pbListPartitionsRsp) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {
+		if f.num != 1 {
+			return
+		}
+		var part pbPartition
+		pbFields(f.bytes, func(f *pbField) {
+			switch f.num {
+			case 1:
+				part.PartitionID = string(f.bytes)
+			case 2:
+				part.Topic = string(f.bytes)
+			case 3:
+				part.Status = PART_S(f.varint)
+			case 4:
+				var rep pbReplica
+				pbFields(f.bytes, func(f *pbField) {
+					switch f.num {
+					case 1:
+						rep.Broker = string(f.bytes)
+					case 2:
+						rep.Endpoint = string(f.bytes)
+					case 3:
+						rep.Grpc = string(f.bytes)
+					case 4:
+						rep.Role = PART_S(f.varint)
+					}
+				})
+				part.Replicas = append(part.Replicas, rep)
+			}
+		})
+		m.Partitions = append(m.Partitions, part)
+	})
+}
+
+type pbCommitOffsetReq struct {
+	ConsumerID  string
+	Topic       string
+	Offset      uint64
+	PartitionID string
+}
+
+func (m *pbCommitOffsetReq) marshalPB() []byte {
+	b := pbAppendString(nil, 1, m.ConsumerID)
+	b = pbAppendString(b, 2, m.Topic)
+	b = pbAppendVarint(b, 3, m.Offset)
+	b = pbAppendString(b, 4, m.PartitionID)
+	return b
+}
+
+func (m *pbCommitOffsetReq) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {
+		switch f.num {
+		case 1:
+			m.ConsumerID = string(f.bytes)
+		case 2:
+			m.Topic = string(f.bytes)
+		case 3:
+			m.Offset = f.varint
+		case 4:
+			m.PartitionID = string(f.bytes)
+		}
+	})
+}
+
+type pbCommitOffsetRsp struct {
+}
+
+func (m *pbCommitOffsetRsp) marshalPB() []byte {
+	return nil
+}
+
+func (m *pbCommitOffsetRsp) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {})
+}
+
+type pbGetOffsetReq struct {
+	ConsumerID  string
+	Topic       string
+	PartitionID string
+}
+
+func (m *pbGetOffsetReq) marshalPB() []byte {
+	b := pbAppendString(nil, 1, m.ConsumerID)
+	b = pbAppendString(b, 2, m.Topic)
+	b = pbAppendString(b, 3, m.PartitionID)
+	return b
+}
+
+func (m *pbGetOffsetReq) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {
+		switch f.num {
+		case 1:
+			m.ConsumerID = string(f.bytes)
+		case 2:
+			m.Topic = string(f.bytes)
+		case 3:
+			m.PartitionID = string(f.bytes)
+		}
+	})
+}
+
+type pbGetOffsetRsp struct {
+	Offset uint64
+	Found  bool
+}
+
+func (m *pbGetOffsetRsp) marshalPB() []byte {
+	b := pbAppendVarint(nil, 1, m.Offset)
+	b = pbAppendVarint(b, 2, pbBool(m.Found))
+	return b
+}
+
+func (m *pbGetOffsetRsp) unmarshalPB(b []byte) error {
+	return pbFields(b, func(f *pbField) {
+		switch f.num {
+		case 1:
+			m.Offset = f.varint
+		case 2:
+			m.Found = f.varint != 0
+		}
+	})
+}
+
+func grpcError(err error) error {
+	switch err {
+	case ErrUnknownPartition:
+		return status.Error(codes.NotFound, err.Error())
+	case ErrAcksInvalid, ErrMessageTooLarge:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case ErrNotPrimary:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case ErrNoEtcd:
+		return status.Error(codes.Unavailable, err.Error())
+	case ErrAckTimeout:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case ErrOffsetOutOfRange:
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+type grpcService struct{}
+
+func (grpcService) Produce(ctx context.Context, req *pbProduceReq) (*pbProduceRsp, error) {
+	if req.Acks.Valid() == false {
+		return nil, grpcError(ErrAcksInvalid)
+	}
+
+	records := req.Records
+	if len(records) == 0 {
+		for _, v := range req.Messages {
+			records = append(records, Message{Body: v})
+		}
+	}
+
+	rsp := &pbProduceRsp{Offsets: make([]uint64, 0, len(records))}
+
+	if len(records) > 0 {
+		first, last, err := gPartitionMng.PutMessages(req.PartitionID, records)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		for offset := first; offset <= last; offset++ {
+			rsp.Offsets = append(rsp.Offsets, offset)
+		}
+	}
+
+	if len(rsp.Offsets) > 0 {
+		last := rsp.Offsets[len(rsp.Offsets)-1]
+		err := gPartitionMng.WaitAcks(req.PartitionID, last, req.Acks, acksTimeout(req.TimeoutMs))
+		if err != nil {
+			return nil, grpcError(err)
+		}
+	}
+
+	return rsp, nil
+}
+
+/* 整个流使用同一个迭代器, 沿着日志文件顺序读取 */
+func (grpcService) Fetch(req *pbFetchReq, stream grpc.ServerStream) error {
+	iter, err := gPartitionMng.NewIterator(req.PartitionID, req.Offset)
+	if err != nil {
+		return grpcError(err)
+	}
+	count := 0
+
+	for req.MaxCount == 0 || count < int(req.MaxCount) {
+
+		batch := GRPC_FETCHBATCH
+		if req.MaxCount != 0 && int(req.MaxCount)-count < batch {
+			batch = int(req.MaxCount) - count
+		}
+
+		records := iter.Range(batch, FETCH_MAXBYTES)
+		if iter.Err() != nil {
+			return grpcError(iter.Err())
+		}
+
+		if len(records) == 0 {
+			if req.Follow == false {
+				return nil
+			}
+			select {
+			case <-stream.Context().Done():
+				return stream.Context().Err()
+			case <-time.After(GRPC_FETCHWAIT):
+			}
+			continue
+		}
+
+		rsp := &pbFetchRsp{Records: make([]Message, 0, len(records))}
+		for _, raw := range records {
+			msgrec, err := DecodeMsgRec(raw)
+			if err != nil {
+				return grpcError(err)
+			}
+			rsp.Records = append(rsp.Records, msgrec.Message())
+		}
+
+		err = stream.SendMsg(rsp)
+		if err != nil {
+			return err
+		}
+
+		count += len(rsp.Records)
+	}
+
+	return nil
+}
+
+func (grpcService) ListPartitions(ctx context.Context, req *pbListPartitionsReq) (*pbListPartitionsRsp, error) {
+	if gEtcd == nil {
+		return nil, grpcError(ErrNoEtcd)
+	}
+
+	brokerlist, err := BrokerServerGet(gEtcd)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	topiclist, err := BrokerTopicGet(gEtcd)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	partitionlist, err := BrokerPartitionGet(gEtcd)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	brokers := make(map[string]DataBroker, 0)
+	for _, v := range brokerlist {
+		brokers[v.Broker] = v
+	}
+
+	topics := make(map[string]bool, 0)
+	for _, v := range topiclist {
+		if v.Topic != req.Topic {
+			continue
+		}
+		for _, id := range v.Partitions {
+			topics[id] = true
+		}
+	}
+
+	rsp := new(pbListPartitionsRsp)
+
+	for _, v := range partitionlist {
+		if req.Topic != "" && v.Topic != req.Topic && topics[v.PartitionID] == false {
+			continue
+		}
+
+		part := pbPartition{PartitionID: v.PartitionID, Topic: v.Topic, Status: v.Status}
+		for _, rep := range v.Replicas {
+			brk := brokers[rep.Broker]
+			part.Replicas = append(part.Replicas, pbReplica{
+				Broker: rep.Broker, Endpoint: brk.Addr, Grpc: brk.Grpc, Role: rep.Role})
+		}
+		rsp.Partitions = append(rsp.Partitions, part)
+	}
+
+	return rsp, nil
+}
+
+func (grpcService) CommitOffset(ctx context.Context, req *pbCommitOffsetReq) (*pbCommitOffsetRsp, error) {
+	if gEtcd == nil {
+		return nil, grpcError(ErrNoEtcd)
+	}
+
+	err := BrokerOffsetCommit(gEtcd, req.ConsumerID, req.Topic, req.PartitionID, req.Offset)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &pbCommitOffsetRsp{}, nil
+}
+
+func (grpcService) GetOffset(ctx context.Context, req *pbGetOffsetReq) (*pbGetOffsetRsp, error) {
+	if gEtcd == nil {
+		return nil, grpcError(ErrNoEtcd)
+	}
+
+	consumer, err := BrokerConsumerGet(gEtcd, req.ConsumerID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	sub := consumer.Find(req.Topic, req.PartitionID)
+	if sub != nil {
+		return &pbGetOffsetRsp{Offset: sub.Offset, Found: true}, nil
+	}
+
+	return &pbGetOffsetRsp{}, nil
+}
+
+func grpcUnary(method string, newreq func() pbMessage,
+	call func(ctx context.Context, req pbMessage) (interface{}, error)) grpc.MethodDesc {
+
+	handler := func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+		req := newreq()
+		err := dec(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if interceptor == nil {
+			return call(ctx, req)
+		}
+
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GRPC_SERVICE + "/" + method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(ctx, req.(pbMessage))
+		})
+	}
+
+	return grpc.MethodDesc{MethodName: method, Handler: handler}
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: GRPC_SERVICE,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnary("Produce", func() pbMessage { return new(pbProduceReq) },
+			func(ctx context.Context, req pbMessage) (interface{}, error) {
+				return grpcService{}.Produce(ctx, req.(*pbProduceReq))
+			}),
+		grpcUnary("ListPartitions", func() pbMessage { return new(pbListPartitionsReq) },
+			func(ctx context.Context, req pbMessage) (interface{}, error) {
+				return grpcService{}.ListPartitions(ctx, req.(*pbListPartitionsReq))
+			}),
+		grpcUnary("CommitOffset", func() pbMessage { return new(pbCommitOffsetReq) },
+			func(ctx context.Context, req pbMessage) (interface{}, error) {
+				return grpcService{}.CommitOffset(ctx, req.(*pbCommitOffsetReq))
+			}),
+		grpcUnary("GetOffset", func() pbMessage { return new(pbGetOffsetReq) },
+			func(ctx context.Context, req pbMessage) (interface{}, error) {
+				return grpcService{}.GetOffset(ctx, req.(*pbGetOffsetReq))
+			}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Fetch",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(pbFetchReq)
+				err := stream.RecvMsg(req)
+				if err != nil {
+					return err
+				}
+				return grpcService{}.Fetch(req, stream)
+			},
+		},
+	},
+	Metadata: "broker.proto",
+}
+
+type GrpcServer struct {
+	Addr     string
+	listener net.Listener
+	server   *grpc.Server
+}
+
+func NewGrpcServer(addr string) (*GrpcServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(GrpcServer)
+	s.Addr = listener.Addr().String()
+	s.listener = listener
+	s.server = grpc.NewServer(grpc.ForceServerCodec(pbCodec{}))
+	s.server.RegisterService(&grpcServiceDesc, grpcService{})
+
+	return s, nil
+}
+
+func (s *GrpcServer) Serve() error {
+	return s.server.Serve(s.listener)
+}
+
+func (s *GrpcServer) Stop() {
+	s.server.Stop()
+}
+
+var grpcEndpoint string
+
+func BrokerGrpcEndpointSet(addr string) {
+	grpcEndpoint = addr
+}
+
+func grpcStart() *GrpcServer {
+	if grpcEndpoint == "" {
+		return nil
+	}
+
+	server, err := NewGrpcServer(grpcEndpoint)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	go func() {
+		err := server.Serve()
+		if err != nil {
+			log.Println("grpc server exit!", err.Error())
+		}
+	}()
+
+	log.Println("grpc listen on " + server.Addr)
+
+	return server
+}
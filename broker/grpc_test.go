@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestGrpc01(t *testing.T) {
+	part := NewPartition("0x975318642", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewGrpcServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(server.Addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(pbCodec{})))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer conn.Close()
+
+	req := &pbProduceReq{PartitionID: part.ID}
+	for i := 0; i < 250; i++ {
+		req.Messages = append(req.Messages, []byte(fmt.Sprintf("helloworld%d", i)))
+	}
+
+	rsp := new(pbProduceRsp)
+	err = conn.Invoke(context.Background(), "/"+GRPC_SERVICE+"/Produce", req, rsp)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if len(rsp.Offsets) != 250 || rsp.Offsets[0] != 1 || rsp.Offsets[249] != 250 {
+		t.Errorf("produce offsets invalid! %v", rsp.Offsets)
+		return
+	}
+
+	desc := &grpc.StreamDesc{StreamName: "Fetch", ServerStreams: true}
+	stream, err := conn.NewStream(context.Background(), desc, "/"+GRPC_SERVICE+"/Fetch")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	err = stream.SendMsg(&pbFetchReq{PartitionID: part.ID, Offset: 1, MaxCount: 200})
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	count := 0
+	for {
+		fetch := new(pbFetchRsp)
+		err = stream.RecvMsg(fetch)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		for _, v := range fetch.Records {
+			if string(v.Body) != fmt.Sprintf("helloworld%d", count) || v.Offset != uint64(count+1) {
+				t.Errorf("fetch record invalid! %d %s", v.Offset, v.Body)
+				return
+			}
+			count++
+		}
+	}
+
+	if count != 200 {
+		t.Errorf("fetch count %d invalid!", count)
+	}
+
+	err = conn.Invoke(context.Background(), "/"+GRPC_SERVICE+"/Produce",
+		&pbProduceReq{PartitionID: "0xnotexist", Messages: [][]byte{[]byte("hello")}}, rsp)
+	if err == nil {
+		t.Errorf("produce to unknown partition should fail!")
+	}
+
+	part.Reset()
+}
@@ -0,0 +1,483 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * REST 接口:
+ *   POST /topics/{topic}/messages?acks=all&timeout=T&partition=ID&key=K&encoding=E
+ *                                                  请求体为一条消息, timeout 单位毫秒, partition 和 key 可选,
+ *                                                  没有指定分区时按 key 的一致性哈希选择分区
+ *   GET  /partitions/{id}/messages?offset=N&max=M&encoding=E
+ *                                                  读取消息
+ *   GET  /cluster                                  集群信息
+ * 分区不在本节点时重定向到主副本所在节点的 http 地址.
+ * encoding 为消息 key 和 body 的编码, 默认 text 原样传递; 二进制消息使用 base64,
+ * 生产时请求体和 key 按 base64 解码, 读取时应答中的 key 和 body 按 base64 编码.
+ */
+
+const (
+	HTTP_MAXBODY  = FRAME_MAXSIZE
+	HTTP_FETCHMAX = 100
+)
+
+const (
+	HTTP_ENCODING_TEXT   = "text"
+	HTTP_ENCODING_BASE64 = "base64"
+)
+
+type HttpMessage struct {
+	Offset    uint64            `json:"offset"`
+	Key       string            `json:"key,omitempty"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body"`
+}
+
+type HttpProduceRsp struct {
+	Topic       string `json:"topic"`
+	PartitionID string `json:"partitionid"`
+	Offset      uint64 `json:"offset"`
+}
+
+type HttpFetchRsp struct {
+	PartitionID string        `json:"partitionid"`
+	Encoding    string        `json:"encoding"`
+	Messages    []HttpMessage `json:"messages"`
+}
+
+type HttpClusterRsp struct {
+	Cluster    string          `json:"cluster"`
+	Common     DataCommon      `json:"common"`
+	Brokers    []DataBroker    `json:"brokers"`
+	Topics     []DataTopic     `json:"topics"`
+	Partitions []DataPartition `json:"partitions"`
+}
+
+type HttpServer struct {
+	Addr     string
+	listener net.Listener
+	server   *http.Server
+}
+
+func NewHttpServer(addr string) (*HttpServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topics/", httpTopics)
+	mux.HandleFunc("/partitions/", httpPartitions)
+	mux.HandleFunc("/cluster", httpCluster)
+
+	s := new(HttpServer)
+	s.Addr = listener.Addr().String()
+	s.listener = listener
+	s.server = &http.Server{Handler: mux}
+
+	return s, nil
+}
+
+func (s *HttpServer) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *HttpServer) Stop() {
+	s.server.Close()
+}
+
+func httpReply(w http.ResponseWriter, code int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		code = http.StatusInternalServerError
+		body = []byte(`{"error":"` + err.Error() + `"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func httpEncoding(r *http.Request) (string, error) {
+	switch value := r.URL.Query().Get("encoding"); value {
+	case "", HTTP_ENCODING_TEXT:
+		return HTTP_ENCODING_TEXT, nil
+	case HTTP_ENCODING_BASE64:
+		return value, nil
+	}
+	return "", ErrBadRequest
+}
+
+func httpEncode(encoding string, value []byte) string {
+	if encoding == HTTP_ENCODING_BASE64 {
+		return base64.StdEncoding.EncodeToString(value)
+	}
+	return string(value)
+}
+
+func httpDecode(encoding string, value []byte) ([]byte, error) {
+	if encoding == HTTP_ENCODING_BASE64 {
+		return base64.StdEncoding.DecodeString(string(value))
+	}
+	return value, nil
+}
+
+/* 多读一个字节判断请求体是否超过上限, 超过时返回错误, 不截断写入 */
+func httpReadBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, HTTP_MAXBODY+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > HTTP_MAXBODY {
+		return nil, ErrMessageTooLarge
+	}
+	return body, nil
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	switch err {
+	case ErrUnknownPartition:
+		code = http.StatusNotFound
+	case ErrIsNone:
+		code = http.StatusNotFound
+	case ErrNotPrimary:
+		code = http.StatusMisdirectedRequest
+	case ErrNoEtcd:
+		code = http.StatusServiceUnavailable
+	case ErrAckTimeout:
+		code = http.StatusGatewayTimeout
+	case ErrOffsetOutOfRange:
+		code = http.StatusRequestedRangeNotSatisfiable
+	case ErrMessageTooLarge:
+		code = http.StatusRequestEntityTooLarge
+	}
+	httpReply(w, code, map[string]string{"error": err.Error()})
+}
+
+/* 将 /prefix/{name}/messages 拆分出 name */
+func httpPathParam(path string, prefix string) (string, bool) {
+	list := strings.Split(strings.TrimPrefix(path, prefix), "/")
+	if len(list) != 2 || list[0] == "" || list[1] != "messages" {
+		return "", false
+	}
+	return list[0], true
+}
+
+/* 分区不在本节点时, 找到主副本所在节点的 http 地址重定向 */
+func httpRedirect(w http.ResponseWriter, r *http.Request, partitionId string) bool {
+	if gPartitionMng.Exist(partitionId) || gEtcd == nil {
+		return false
+	}
+
+	/* etcd 异常时按本地分区处理, 返回分区不存在 */
+	partitions, err := BrokerPartitionGet(gEtcd)
+	if err != nil {
+		log.Println("http redirect get partition failed!", partitionId, err.Error())
+		return false
+	}
+	brokers, err := BrokerServerGet(gEtcd)
+	if err != nil {
+		log.Println("http redirect get broker failed!", partitionId, err.Error())
+		return false
+	}
+
+	var primary string
+	for _, v := range partitions {
+		if v.PartitionID != partitionId {
+			continue
+		}
+		for _, rep := range v.Replicas {
+			if rep.Role == PART_S_PRIMARY {
+				primary = rep.Broker
+			}
+		}
+	}
+
+	for _, v := range brokers {
+		if v.Broker == primary && v.Http != "" {
+			http.Redirect(w, r, "http://"+v.Http+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+ * 请求中没有指定分区时优先选择本节点为主副本的分区, 避免重定向,
+ * 需要重定向时把选中的分区加到请求参数中.
+ * key 为解码后的消息 key, 与 Producer 按相同的字节选择分区.
+ */
+var httpPartitioner = NewHashPartitioner()
+
+func httpTopicPartition(r *http.Request, topic *DataTopic, key []byte) (string, error) {
+	query := r.URL.Query()
+	if value := query.Get("partition"); value != "" {
+		if stringsHas(topic.Partitions, value) == false {
+			return "", ErrUnknownPartition
+		}
+		return value, nil
+	}
+
+	if len(topic.Partitions) == 0 {
+		return "", ErrUnknownPartition
+	}
+
+	if len(key) > 0 {
+		partitionId, err := httpPartitioner.Partition(topic.Topic, key, topic.Partitions)
+		if err != nil {
+			return "", err
+		}
+		query.Set("partition", partitionId)
+		r.URL.RawQuery = query.Encode()
+		return partitionId, nil
+	}
+
+	for _, v := range topic.Partitions {
+		if gPartitionMng.Exist(v) && gPartitionMng.Primary(v) == gPartitionMng.BrokerName {
+			return v, nil
+		}
+	}
+
+	partitionId := topic.Partitions[rand.Intn(len(topic.Partitions))]
+	query.Set("partition", partitionId)
+	r.URL.RawQuery = query.Encode()
+
+	return partitionId, nil
+}
+
+func httpTopics(w http.ResponseWriter, r *http.Request) {
+	topic, b := httpPathParam(r.URL.Path, "/topics/")
+	if b == false {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, ErrBadRequest)
+		return
+	}
+
+	acks := ACKS_PRIMARY
+	if value := r.URL.Query().Get("acks"); value != "" {
+		var err error
+		acks, err = ParseAcks(value)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	encoding, err := httpEncoding(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var timeout uint64
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+		timeout, err = strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrBadRequest)
+			return
+		}
+	}
+
+	if gEtcd == nil {
+		httpError(w, 0, ErrNoEtcd)
+		return
+	}
+
+	datatopic, err := BrokerTopicFind(gEtcd, topic)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var key []byte
+	if value := r.URL.Query().Get("key"); value != "" {
+		key, err = httpDecode(encoding, []byte(value))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrBadRequest)
+			return
+		}
+	}
+
+	partitionId, err := httpTopicPartition(r, datatopic, key)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if httpRedirect(w, r, partitionId) {
+		return
+	}
+
+	body, err := httpReadBody(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err = httpDecode(encoding, body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrBadRequest)
+		return
+	}
+
+	offset, err := gPartitionMng.PutMessage(partitionId, &Message{Key: key, Body: body})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = gPartitionMng.WaitAcks(partitionId, offset, acks, acksTimeout(uint32(timeout)))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	httpReply(w, http.StatusOK, HttpProduceRsp{
+		Topic: topic, PartitionID: partitionId, Offset: offset})
+}
+
+func httpPartitions(w http.ResponseWriter, r *http.Request) {
+	partitionId, b := httpPathParam(r.URL.Path, "/partitions/")
+	if b == false {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, ErrBadRequest)
+		return
+	}
+
+	offset, err := strconv.ParseUint(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrBadRequest)
+		return
+	}
+
+	maxcount := 1
+	if value := r.URL.Query().Get("max"); value != "" {
+		maxcount, err = strconv.Atoi(value)
+		if err != nil || maxcount <= 0 {
+			httpError(w, http.StatusBadRequest, ErrBadRequest)
+			return
+		}
+		if maxcount > HTTP_FETCHMAX {
+			maxcount = HTTP_FETCHMAX
+		}
+	}
+
+	encoding, err := httpEncoding(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if httpRedirect(w, r, partitionId) {
+		return
+	}
+
+	records, _, _, err := gPartitionMng.Fetch(partitionId, offset, maxcount, FETCH_MAXBYTES)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rsp := HttpFetchRsp{PartitionID: partitionId, Encoding: encoding, Messages: make([]HttpMessage, 0, len(records))}
+	for _, raw := range records {
+		msgrec, err := DecodeMsgRec(raw)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		rsp.Messages = append(rsp.Messages, HttpMessage{Offset: msgrec.offset, Key: httpEncode(encoding, msgrec.key),
+			Timestamp: msgrec.timestamp, Headers: msgrec.headers, Body: httpEncode(encoding, msgrec.body)})
+	}
+
+	httpReply(w, http.StatusOK, rsp)
+}
+
+func httpCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, ErrBadRequest)
+		return
+	}
+
+	if gEtcd == nil {
+		httpError(w, 0, ErrNoEtcd)
+		return
+	}
+
+	rsp := HttpClusterRsp{Cluster: CLUSTER_NAME}
+
+	cfg, err := BrokerPublicGet(gEtcd)
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	rsp.Common = *cfg
+
+	rsp.Brokers, err = BrokerServerGet(gEtcd)
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	rsp.Topics, err = BrokerTopicGet(gEtcd)
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	rsp.Partitions, err = BrokerPartitionGet(gEtcd)
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	httpReply(w, http.StatusOK, rsp)
+}
+
+var httpEndpoint string
+
+func BrokerHttpEndpointSet(addr string) {
+	httpEndpoint = addr
+}
+
+func httpStart() *HttpServer {
+	if httpEndpoint == "" {
+		return nil
+	}
+
+	server, err := NewHttpServer(httpEndpoint)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	go func() {
+		err := server.Serve()
+		if err != nil {
+			log.Println("http server exit!", err.Error())
+		}
+	}()
+
+	log.Println("http listen on " + server.Addr)
+
+	return server
+}
@@ -0,0 +1,189 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHttp01(t *testing.T) {
+	part := NewPartition("0x864213579", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+
+	for i := 0; i < 10; i++ {
+		part.Write([]byte(fmt.Sprintf("helloworld%d", i)))
+	}
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewHttpServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	url := fmt.Sprintf("http://%s/partitions/%s/messages?offset=3&max=5", server.Addr, part.ID)
+
+	rsp, err := http.Get(url)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		t.Errorf("http status %d invalid!", rsp.StatusCode)
+		return
+	}
+
+	var fetch HttpFetchRsp
+	err = json.NewDecoder(rsp.Body).Decode(&fetch)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(fetch.Messages) != 5 {
+		t.Errorf("fetch messages %d invalid!", len(fetch.Messages))
+		return
+	}
+
+	for i, v := range fetch.Messages {
+		if v.Offset != uint64(i+3) || v.Body != fmt.Sprintf("helloworld%d", i+2) {
+			t.Errorf("fetch message invalid! %v", v)
+		}
+	}
+
+	rsp2, err := http.Get(fmt.Sprintf("http://%s/partitions/%s/messages?offset=1", server.Addr, "0xnotexist"))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	rsp2.Body.Close()
+
+	if rsp2.StatusCode != http.StatusNotFound {
+		t.Errorf("http status %d invalid!", rsp2.StatusCode)
+	}
+
+	part.Reset()
+}
+
+func TestHttp02(t *testing.T) {
+	part := NewPartition("0x864213580", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+
+	body := []byte{0xff, 0x00, 0xfe, 0x80}
+	part.Write(body)
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewHttpServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	rsp, err := http.Get(fmt.Sprintf("http://%s/partitions/%s/messages?offset=1&encoding=base64", server.Addr, part.ID))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer rsp.Body.Close()
+
+	var fetch HttpFetchRsp
+	err = json.NewDecoder(rsp.Body).Decode(&fetch)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if fetch.Encoding != HTTP_ENCODING_BASE64 || len(fetch.Messages) != 1 {
+		t.Errorf("fetch response invalid! %v", fetch)
+		return
+	}
+
+	value, err := base64.StdEncoding.DecodeString(fetch.Messages[0].Body)
+	if err != nil || bytes.Equal(value, body) == false {
+		t.Errorf("fetch binary body invalid! %v %v", value, err)
+	}
+
+	rsp2, err := http.Get(fmt.Sprintf("http://%s/partitions/%s/messages?offset=1&encoding=hex", server.Addr, part.ID))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	rsp2.Body.Close()
+
+	if rsp2.StatusCode != http.StatusBadRequest {
+		t.Errorf("http status %d invalid!", rsp2.StatusCode)
+	}
+
+	part.Reset()
+}
+
+func TestHttp03(t *testing.T) {
+	topic := &DataTopic{Topic: "httptopic", Partitions: []string{"0x01", "0x02", "0x03", "0x04", "0x05"}}
+
+	for i := 0; i < 20; i++ {
+		key := []byte{0xff, byte(i), 0x00, byte(i * 7)}
+		expect, err := NewHashPartitioner().Partition(topic.Topic, key, topic.Partitions)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		url := "/topics/httptopic/messages?encoding=base64&key=" + url.QueryEscape(base64.StdEncoding.EncodeToString(key))
+		r, _ := http.NewRequest(http.MethodPost, url, nil)
+
+		/* 与 Producer 一样按解码后的 key 选择分区 */
+		value, err := httpDecode(HTTP_ENCODING_BASE64, []byte(r.URL.Query().Get("key")))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		partitionId, err := httpTopicPartition(r, topic, value)
+		if err != nil || partitionId != expect {
+			t.Errorf("http key partition invalid! %s %s %v", partitionId, expect, err)
+		}
+	}
+}
+
+func TestHttp04(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "/topics/httptopic/messages", bytes.NewReader(make([]byte, HTTP_MAXBODY)))
+	body, err := httpReadBody(r)
+	if err != nil || len(body) != HTTP_MAXBODY {
+		t.Errorf("read http body failed! %d %v", len(body), err)
+	}
+
+	/* 超过上限的请求体不能截断后写入 */
+	r, _ = http.NewRequest(http.MethodPost, "/topics/httptopic/messages", bytes.NewReader(make([]byte, HTTP_MAXBODY+1)))
+	_, err = httpReadBody(r)
+	if err != ErrMessageTooLarge {
+		t.Errorf("large http body should be rejected! %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	httpError(w, http.StatusBadRequest, err)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("http status %d invalid!", w.Code)
+	}
+}
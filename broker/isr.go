@@ -0,0 +1,247 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	ISR_LAGTIME   = 10 * time.Second
+	ISR_CHECKWAIT = time.Second
+)
+
+/* 从副本的复制进度 */
+type replicaState struct {
+	offset   uint64    /* 从副本已经写入的最后偏移 */
+	fetchEnd uint64    /* 上次拉取时主副本的最后偏移 */
+	caughtUp time.Time /* 最近一次追上主副本的时间 */
+}
+
+/*
+ * 主副本跟踪各从副本的复制进度, 超过 ISR_LAGTIME 没有追上的从副本移出同步副本集合,
+ * 追上后重新加入. 集合的变化先写入 etcd 中的分区记录, 再用于计算高水位,
+ * 保证故障切换时选出的同步副本包含所有消费者读到过的消息.
+ */
+type isrTracker struct {
+	sync.Mutex
+
+	partition *Partition
+	replicas  map[string]*replicaState
+	followers []string
+	isr       []string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newIsrTracker(part *Partition, cfg DataPartition) *isrTracker {
+	t := new(isrTracker)
+	t.partition = part
+	t.replicas = make(map[string]*replicaState, 0)
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	t.update(cfg)
+
+	log.Println("isr tracker start!", part.ID, t.isr)
+
+	go t.run()
+
+	return t
+}
+
+func (t *isrTracker) stop() {
+	t.cancel()
+	log.Println("isr tracker stop!", t.partition.ID)
+}
+
+/* 分区配置变化后同步从副本列表和 etcd 中的同步副本集合 */
+func (t *isrTracker) update(cfg DataPartition) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	followers := make([]string, 0)
+	replicas := make(map[string]*replicaState, 0)
+
+	for _, rep := range cfg.Replicas {
+		if rep.Broker == gPartitionMng.BrokerName {
+			continue
+		}
+		state, b := t.replicas[rep.Broker]
+		if b == false {
+			state = &replicaState{fetchEnd: t.partition.CurOffset()}
+			if stringsHas(cfg.ISR, rep.Broker) {
+				state.caughtUp = now
+			}
+		}
+		replicas[rep.Broker] = state
+		followers = append(followers, rep.Broker)
+	}
+
+	t.replicas = replicas
+	t.followers = followers
+
+	if len(cfg.ISR) != 0 {
+		t.isr = cfg.ISR
+	} else if t.isr == nil {
+		t.isr = []string{gPartitionMng.BrokerName}
+	}
+
+	t.apply()
+}
+
+/* 将同步副本集合中的从副本交给分区计算高水位 */
+func (t *isrTracker) apply() {
+	list := make(map[string]uint64, 0)
+	for _, name := range t.isr {
+		state, b := t.replicas[name]
+		if b {
+			list[name] = state.offset
+		}
+	}
+	t.partition.SetSyncReplicas(list)
+}
+
+/*
+ * 从副本请求 offset 之后的消息, 说明 offset 之前的消息已经写入.
+ * 不是分区副本的请求返回 ErrNotReplica; 超过主副本最后偏移的部分不可能已经写入, 按最后偏移计算.
+ */
+func (t *isrTracker) fetched(replica string, offset uint64) error {
+	t.Lock()
+	state, b := t.replicas[replica]
+	if b == false {
+		t.Unlock()
+		return ErrNotReplica
+	}
+	cur := t.partition.CurOffset()
+	if offset > cur {
+		offset = cur
+	}
+	state.offset = offset
+	if offset >= state.fetchEnd {
+		state.caughtUp = time.Now()
+	}
+	state.fetchEnd = cur
+	t.Unlock()
+
+	t.partition.ReplicaOffset(replica, offset)
+	return nil
+}
+
+func (t *isrTracker) expect() []string {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	isr := []string{gPartitionMng.BrokerName}
+
+	for _, name := range t.followers {
+		if now.Sub(t.replicas[name].caughtUp) <= ISR_LAGTIME {
+			isr = append(isr, name)
+		}
+	}
+	return isr
+}
+
+func (t *isrTracker) check() error {
+	isr := t.expect()
+
+	t.Lock()
+	old := t.isr
+	followers := t.followers
+	t.Unlock()
+
+	if isrEqual(isr, old) {
+		return nil
+	}
+
+	if gEtcd != nil {
+		var primary bool
+		err := BrokerPartitionUpdate(gEtcd, t.partition.ID, func(partition *DataPartition) bool {
+			primary = isrPrimary(partition, gPartitionMng.BrokerName)
+			if primary == false {
+				return false
+			}
+			old = partition.ISR
+			isr = isrNext(partition, isr, followers)
+			return isrEqual(isr, old) == false
+		})
+		if err != nil {
+			return err
+		}
+		/* 已经不是主副本, 等待分区配置的变化停止跟踪 */
+		if primary == false {
+			return ErrNotPrimary
+		}
+	}
+
+	if isrEqual(isr, old) == false {
+		log.Println("partition isr change!", t.partition.ID, old, isr)
+	}
+
+	t.Lock()
+	t.isr = isr
+	t.apply()
+	t.Unlock()
+
+	return nil
+}
+
+func isrEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, name := range a {
+		if stringsHas(b, name) == false {
+			return false
+		}
+	}
+	return true
+}
+
+/* 只有 etcd 中的分区记录仍然把本节点作为主副本时才能修改同步副本集合 */
+func isrPrimary(partition *DataPartition, broker string) bool {
+	for _, rep := range partition.Replicas {
+		if rep.Broker == broker {
+			return rep.Role == PART_S_PRIMARY
+		}
+	}
+	return false
+}
+
+/*
+ * 在 etcd 中最新的同步副本集合上修改: 只增删本节点跟踪的从副本,
+ * 还没有开始跟踪的副本保持原来的状态, 已经移出分区的副本从集合中删除.
+ */
+func isrNext(partition *DataPartition, expect []string, followers []string) []string {
+	isr := make([]string, 0, len(partition.Replicas))
+	for _, rep := range partition.Replicas {
+		var in bool
+		if stringsHas(followers, rep.Broker) {
+			in = stringsHas(expect, rep.Broker)
+		} else {
+			in = stringsHas(expect, rep.Broker) || stringsHas(partition.ISR, rep.Broker)
+		}
+		if in {
+			isr = append(isr, rep.Broker)
+		}
+	}
+	return isr
+}
+
+func (t *isrTracker) run() {
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(ISR_CHECKWAIT):
+		}
+
+		err := t.check()
+		if err != nil {
+			log.Println("partition isr update failed!", t.partition.ID, err.Error())
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestIsr01(t *testing.T) {
+	partition := DataPartition{
+		PartitionID: "0x123",
+		Replicas: []PartReplicas{
+			{Broker: "broker1", Role: PART_S_FOLLOW},
+			{Broker: "broker2", Role: PART_S_PRIMARY},
+		},
+		ISR: []string{"broker1", "broker2"},
+	}
+
+	if isrPrimary(&partition, "broker1") {
+		t.Errorf("broker1 is not primary any more!")
+	}
+	if isrPrimary(&partition, "broker2") == false {
+		t.Errorf("broker2 should be primary!")
+	}
+	if isrPrimary(&partition, "broker3") {
+		t.Errorf("broker3 is not replica!")
+	}
+}
+
+func TestIsr02(t *testing.T) {
+	partition := DataPartition{
+		PartitionID: "0x456",
+		Replicas: []PartReplicas{
+			{Broker: "broker1", Role: PART_S_PRIMARY},
+			{Broker: "broker2", Role: PART_S_FOLLOW},
+			{Broker: "broker4", Role: PART_S_FOLLOW},
+		},
+		ISR: []string{"broker1", "broker2", "broker4"},
+	}
+
+	/* broker2 落后移出, broker3 已经不是副本, broker4 还没有开始跟踪保持原状 */
+	isr := isrNext(&partition, []string{"broker1", "broker3"}, []string{"broker2", "broker3"})
+	if isrEqual(isr, []string{"broker1", "broker4"}) == false {
+		t.Errorf("partition isr invalid! %v", isr)
+	}
+
+	partition.ISR = []string{"broker1"}
+	isr = isrNext(&partition, []string{"broker1", "broker2"}, []string{"broker2", "broker4"})
+	if isrEqual(isr, []string{"broker1", "broker2"}) == false {
+		t.Errorf("partition isr invalid! %v", isr)
+	}
+}
+
+func TestIsr03(t *testing.T) {
+	part := NewPartition("0x789", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+	part.SetSyncReplicas(map[string]uint64{"broker2": 0})
+
+	for i := 0; i < 3; i++ {
+		part.Write([]byte("helloworld"))
+	}
+
+	tracker := &isrTracker{partition: part, replicas: map[string]*replicaState{"broker2": {}}}
+
+	/* 不是分区副本的请求不能推进高水位 */
+	if err := tracker.fetched("broker9", 3); err != ErrNotReplica {
+		t.Errorf("unknown replica should be refused! %v", err)
+	}
+
+	/* 从副本声称的偏移超过主副本时按主副本的最后偏移计算 */
+	if err := tracker.fetched("broker2", 100); err != nil {
+		t.Errorf("replica fetched failed! %v", err)
+	}
+	if tracker.replicas["broker2"].offset != 3 || part.HighWatermark() != 3 {
+		t.Errorf("replica offset invalid! %d %d", tracker.replicas["broker2"].offset, part.HighWatermark())
+	}
+
+	part.Reset()
+}
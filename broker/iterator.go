@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"bufio"
+	"io"
+	"log"
+)
+
+const (
+	ITERATOR_BUFSIZE = 64 * 1024
+)
+
+/*
+ * 顺序读取分区的记录, 按段在 SegList 中的顺序依次读取日志文件, 跨段时从下一个段的开头继续.
+ * 只在创建、段被删除截断或者压缩重写之后按索引重新定位, 其他时候沿着日志文件顺序读取.
+ * committed 为 true 时只读取高水位以内的记录. 不能在多个协程中同时使用.
+ */
+type Iterator struct {
+	part      *Partition
+	committed bool
+
+	next    uint64 /* 下一条记录的偏移不小于 next */
+	err     error
+	pending []byte /* 已经读出但是超过高水位的记录 */
+	pendid  uint64
+
+	seg      *Segment
+	version  uint64
+	position int64 /* 当前段日志文件中下一条记录的位置 */
+	end      int64 /* rd 可以读取到的位置 */
+	rd       *bufio.Reader
+}
+
+func (part *Partition) NewIterator(from uint64, committed bool) *Iterator {
+	return &Iterator{part: part, committed: committed, next: from}
+}
+
+/* 下一条要读取的偏移 */
+func (it *Iterator) Offset() uint64 {
+	return it.next
+}
+
+/* 分区被删除, 或者要读取的记录已经按保留策略删除时返回错误 */
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+/* 返回下一条记录的偏移和原始数据, 暂时没有更多的记录时返回 nil, 之后可以继续调用 */
+func (it *Iterator) Next() (uint64, []byte) {
+	part := it.part
+
+	part.RLock()
+	defer part.RUnlock()
+
+	if part.deleted {
+		it.err = ErrUnknownPartition
+		return INVALID_OFFSET, nil
+	}
+
+	limit := INVALID_OFFSET
+	if it.committed {
+		limit = part.HighWater
+	}
+
+	/* 截断之后读出的记录可能已经不存在 */
+	if it.pending != nil && it.version != part.version {
+		it.pending = nil
+	}
+
+	if it.pending != nil {
+		if it.pendid > limit {
+			return INVALID_OFFSET, nil
+		}
+		id, raw := it.pendid, it.pending
+		it.pending = nil
+		it.next = id + 1
+		return id, raw
+	}
+
+	for it.next <= limit {
+		if it.seg == nil || it.version != part.version {
+			if it.seek() == false {
+				return INVALID_OFFSET, nil
+			}
+		}
+
+		raw, msgrec := it.read()
+		if raw == nil {
+			if it.forward() == false {
+				return INVALID_OFFSET, nil
+			}
+			continue
+		}
+		if msgrec.offset < it.next {
+			continue
+		}
+
+		if msgrec.offset > limit {
+			it.pending, it.pendid = raw, msgrec.offset
+			return INVALID_OFFSET, nil
+		}
+
+		it.next = msgrec.offset + 1
+		return msgrec.offset, raw
+	}
+
+	return INVALID_OFFSET, nil
+}
+
+/* 按索引找到第一条偏移不小于 next 的记录所在的段和位置 */
+func (it *Iterator) seek() bool {
+	part := it.part
+
+	it.seg = nil
+	it.rd = nil
+	it.version = part.version
+
+	if it.next < part.seglist.First().Begin() {
+		it.err = ErrOffsetOutOfRange
+		return false
+	}
+	it.err = nil
+
+	for _, seg := range part.seglist.array {
+		if seg.Empty() || seg.End() < it.next {
+			continue
+		}
+		_, position := seg.idx.Get(seg.idx.Search(it.next))
+		if position == INVALID_OFFSET {
+			return false
+		}
+		it.seg = seg
+		it.position = int64(position)
+		return true
+	}
+
+	return false
+}
+
+/* 读取当前段的下一条记录, 读到当前段已经写入的末尾时返回 nil */
+func (it *Iterator) read() ([]byte, *MsgRec) {
+	logfile := it.seg.log
+
+	/* 最后一个段可能在上次读取之后继续写入 */
+	if it.rd == nil || (it.position == it.end && logfile.curSize > it.end) {
+		it.end = logfile.curSize
+		it.rd = bufio.NewReaderSize(io.NewSectionReader(logfile.fileFd, it.position, it.end-it.position), ITERATOR_BUFSIZE)
+	}
+
+	if it.position >= it.end {
+		return nil, nil
+	}
+
+	raw, msgrec, err := readRecord(it.rd, it.end-it.position)
+	if err != nil {
+		log.Println("iterator read record failed!", it.part.ID, logfile.filename, it.position, err.Error())
+		it.position = it.end
+		return nil, nil
+	}
+	it.position += int64(len(raw))
+
+	return raw, msgrec
+}
+
+/* 当前段读完后切换到下一个段, 已经是最后一个段时返回 false */
+func (it *Iterator) forward() bool {
+	list := it.part.seglist.array
+
+	for i, seg := range list {
+		if seg != it.seg {
+			continue
+		}
+		if i+1 == len(list) {
+			return false
+		}
+		it.seg = list[i+1]
+		it.position = 0
+		it.end = 0
+		it.rd = nil
+		return true
+	}
+
+	it.seg = nil
+	return true
+}
+
+/* 从 from 开始读取高水位以内的记录, 最多 maxCount 条, 超过 maxBytes 时停止, 至少返回一条 */
+func (part *Partition) ReadRange(from uint64, maxCount int, maxBytes int) [][]byte {
+	return part.NewIterator(from, true).Range(maxCount, maxBytes)
+}
+
+func (it *Iterator) Range(maxCount int, maxBytes int) [][]byte {
+	records := make([][]byte, 0)
+	size := 0
+
+	for len(records) < maxCount {
+		id, raw := it.Next()
+		if raw == nil {
+			break
+		}
+		if len(records) > 0 && size+len(raw) > maxBytes {
+			it.pending, it.pendid = raw, id
+			it.next = id
+			break
+		}
+		records = append(records, raw)
+		size += len(raw)
+	}
+
+	return records
+}
@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIterator01(t *testing.T) {
+	part := NewPartition("0x564738203", PART_S_PRIMARY)
+	if part == nil {
+		t.Fatal("new partition failed!")
+	}
+	defer part.Delete()
+
+	body := make([]byte, 256*1024)
+	for i := 1; part.seglist.Len() < 3; i++ {
+		copy(body, fmt.Sprintf("message%d", i))
+		part.Write(body)
+	}
+	last := part.CurOffset()
+
+	/* 跨段顺序读取所有记录 */
+	iter := part.NewIterator(1, true)
+	for offset := uint64(1); offset <= last; offset++ {
+		id, raw := iter.Next()
+		if id != offset || raw == nil {
+			t.Fatalf("iterator read %d failed! %d", offset, id)
+		}
+		rec, err := DecodeMsgRec(raw)
+		if err != nil || string(rec.body[:len(fmt.Sprint(offset))+7]) != fmt.Sprintf("message%d", offset) {
+			t.Fatalf("iterator record %d invalid!", offset)
+		}
+	}
+	if _, raw := iter.Next(); raw != nil {
+		t.Errorf("iterator should be at the end!")
+	}
+
+	/* 新写入的消息继续读取 */
+	offset := part.Write([]byte("helloworld"))
+	if id, raw := iter.Next(); id != offset || raw == nil {
+		t.Errorf("iterator read new message failed! %d", id)
+	}
+
+	/* 截断后重新定位, 读取重新写入的消息 */
+	part.Truncate(offset - 1)
+	offset = part.Write([]byte("helloagain"))
+	iter = part.NewIterator(offset-1, true)
+	iter.Next()
+	part.Truncate(offset - 1)
+	part.Write([]byte("hellothird"))
+	id, raw := iter.Next()
+	rec, _ := DecodeMsgRec(raw)
+	if id != offset || rec == nil || string(rec.body) != "hellothird" {
+		t.Errorf("iterator read after truncate failed! %d", id)
+	}
+}
+
+func TestIterator02(t *testing.T) {
+	part := NewPartition("0x564738204", PART_S_PRIMARY)
+	if part == nil {
+		t.Fatal("new partition failed!")
+	}
+	defer part.Delete()
+
+	for i := 0; i < 100; i++ {
+		part.Write([]byte(fmt.Sprintf("helloworld%d", i)))
+	}
+
+	records := part.ReadRange(1, 10, 1024*1024)
+	if len(records) != 10 {
+		t.Errorf("read range count failed! %d", len(records))
+	}
+
+	size := len(records[0])
+	records = part.ReadRange(1, 100, size*3+1)
+	if len(records) != 3 {
+		t.Errorf("read range bytes failed! %d", len(records))
+	}
+
+	/* 超过字节限制的记录留给下一次读取 */
+	iter := part.NewIterator(95, true)
+	records = iter.Range(100, 1)
+	if len(records) != 1 || iter.Offset() != 96 {
+		t.Errorf("iterator range failed! %d %d", len(records), iter.Offset())
+	}
+	records = iter.Range(100, 1024*1024)
+	if len(records) != 5 {
+		t.Errorf("iterator range after limit failed! %d", len(records))
+	}
+
+	/* 高水位限制已提交的读取, 不限制复制 */
+	part.SetSyncReplicas(map[string]uint64{"follower": 100})
+	part.Write([]byte("uncommitted"))
+	if records = part.ReadRange(100, 10, 1024*1024); len(records) != 1 {
+		t.Errorf("read range should stop at high watermark! %d", len(records))
+	}
+	if records = part.NewIterator(100, false).Range(10, 1024*1024); len(records) != 2 {
+		t.Errorf("uncommitted iterator should read all! %d", len(records))
+	}
+
+	part.ResetStart(200)
+	iter = part.NewIterator(100, true)
+	if _, raw := iter.Next(); raw != nil || iter.Err() != ErrOffsetOutOfRange {
+		t.Errorf("iterator below start should fail! %v", iter.Err())
+	}
+}
@@ -8,6 +8,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+var (
+	ErrOffsetInvalid = errors.New("partition offset is invalid!")
 )
 
 type Partition struct {
@@ -19,7 +24,31 @@ type Partition struct {
 	DirPath string
 	Offset  uint64
 
+	/* 高水位: 同步副本集合都已经写入的最后偏移, 消费者只能读到这里 */
+	HighWater uint64
+	hwnotify  chan struct{}
+
+	/* 同步副本集合中的从副本, 以及各自已经写入的最后偏移 */
+	isr map[string]uint64
+
+	/* 落盘策略, synced 之前的消息已经同步到磁盘, unsynced 为之后写入的字节数 */
+	policy   SyncPolicy
+	synced   uint64
+	unsynced int64
+	syncmu   sync.Mutex
+	syncstop chan struct{}
+
+	/* 段被删除、截断或者重写时递增, 迭代器据此重新定位 */
+	version uint64
+
+	/* 压缩不持有分区锁读取旧段, 期间删除或者截断段的操作需要等待压缩完成 */
+	cleanmu sync.Mutex
+
+	/* 墓碑偏移到压缩时第一次发现的时间, 由 cleanmu 保护, 重启后重新计时 */
+	tombstones map[uint64]time.Time
+
 	seglist *SegList
+	deleted bool
 }
 
 func MkDir(file string) error {
@@ -55,6 +84,39 @@ func WorkPath(id string) string {
 	return path
 }
 
+/* 本节点上所有分区目录的 ID */
+func WorkPathList() []string {
+	list := make([]string, 0)
+
+	entries, err := os.ReadDir(fmt.Sprintf("./%s", CLUSTER_NAME))
+	if err != nil {
+		return list
+	}
+	for _, v := range entries {
+		if v.IsDir() {
+			list = append(list, v.Name())
+		}
+	}
+	return list
+}
+
+/* 删除不再分配给本节点的分区目录, broker 离线期间副本被迁移走时使用 */
+func RemoveWorkPath(id string) {
+	path := fmt.Sprintf("./%s/%s", CLUSTER_NAME, id)
+
+	_, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	log.Println("remove partition path!", path)
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
 func CovPath(path string) []*Segment {
 
 	dir, err := os.Open(path)
@@ -102,45 +164,179 @@ func NewPartition(id string, status PART_S) *Partition {
 	part.ID = id
 	part.Status = status
 	part.DirPath = WorkPath(id)
+	part.isr = make(map[string]uint64, 0)
+	part.hwnotify = make(chan struct{})
 	part.seglist = NewSegList()
 
 	addseglist := CovPath(part.DirPath)
 	if len(addseglist) > 0 {
 		part.seglist.Add(addseglist...)
 	} else {
-		seg := NewSegment(part.DirPath, 0)
+		seg := NewSegment(part.DirPath, 1)
 		part.seglist.Add(seg)
 	}
-	part.Offset = part.seglist.Last().End()
+
+	last := part.seglist.Last()
+	if last.Empty() {
+		part.Offset = offsetBefore(last.Begin())
+	} else {
+		part.Offset = last.End()
+	}
+	part.HighWater = part.Offset
+	part.synced = part.Offset
+	part.policy = SYNC_DEFAULT
 
 	return part
 }
 
+/* start 之前的偏移; 旧版本的第一个段从 0 开始, 这时为 0, 不能下溢 */
+func offsetBefore(start uint64) uint64 {
+	if start == 0 {
+		return 0
+	}
+	return start - 1
+}
+
 func (part *Partition) CurOffset() uint64 {
+	part.RLock()
+	defer part.RUnlock()
+
 	return part.Offset
 }
 
-func (part *Partition) Write(message []byte) uint64 {
-
-	part.Lock()
-	defer part.Unlock()
+/* 从 id 开始按顺序写入, 当前段写满后切换到新段继续写入 */
+func (part *Partition) write(id uint64, messages []Message) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i := range messages {
+		if messages[i].Timestamp == 0 {
+			messages[i].Timestamp = now
+		}
+	}
 
-	part.Offset++
+	for len(messages) > 0 {
+		last := part.seglist.Last()
+		size := last.Size()
 
-	for {
-		err := part.seglist.Last().Write(part.Offset, message)
+		cnt, err := last.WriteBatch(id, messages)
 		if err == nil {
-			break
+			part.unsynced += last.Size() - size
+			id += uint64(cnt)
+			messages = messages[cnt:]
+			continue
 		}
 		if err == ErrIsFull {
-			seg := NewSegment(part.DirPath, part.Offset)
+			/* 写满的段不再写入, 切换时同步, 之后只需要同步最后一个段 */
+			if part.policy.Mode != SYNC_P_NONE {
+				last.Sync()
+			}
+			seg := NewSegment(part.DirPath, id)
 			part.seglist.Add(seg)
 		} else {
 			log.Fatalln(err.Error())
 		}
 	}
 
-	return part.Offset
+	part.Offset = id - 1
+}
+
+func (part *Partition) Write(message []byte) uint64 {
+	return part.WriteMessage(&Message{Body: message})
+}
+
+/* 写入一条消息, 返回分配的偏移, 没有创建时间的消息使用当前时间. 按落盘策略同步后返回 */
+func (part *Partition) WriteMessage(message *Message) uint64 {
+	_, last := part.WriteMessages([]Message{*message})
+	return last
+}
+
+func (part *Partition) WriteBatch(messages [][]byte) (uint64, uint64) {
+	list := make([]Message, len(messages))
+	for i, v := range messages {
+		list[i].Body = v
+	}
+	return part.WriteMessages(list)
+}
+
+/*
+ * 批量写入, 返回分配的第一个和最后一个偏移, 偏移连续. 所有消息一次编码写入,
+ * 只做一次落盘判断. 没有消息时返回 0, 0.
+ */
+func (part *Partition) WriteMessages(messages []Message) (uint64, uint64) {
+	if len(messages) == 0 {
+		return 0, 0
+	}
+
+	part.Lock()
+	first := part.Offset + 1
+	part.write(first, messages)
+	part.advance()
+	last := part.Offset
+	part.Unlock()
+
+	part.Commit(last)
+
+	return first, last
+}
+
+/*
+ * 作为主副本写入, 状态检查和写入在同一把锁内, 分区已经删除或者不再是主副本时不写入.
+ * 记录超过段的大小上限时读取和压缩都会失败, 整批拒绝.
+ */
+func (part *Partition) writePrimary(messages []Message) (uint64, uint64, error) {
+	if len(messages) == 0 {
+		return 0, 0, nil
+	}
+
+	for i := range messages {
+		if msgRecSize(&messages[i]) > SEGMENT_MAXSIZE {
+			return INVALID_OFFSET, INVALID_OFFSET, ErrMessageTooLarge
+		}
+	}
+
+	part.Lock()
+	if part.deleted {
+		part.Unlock()
+		return INVALID_OFFSET, INVALID_OFFSET, ErrUnknownPartition
+	}
+	if part.Status != PART_S_PRIMARY {
+		part.Unlock()
+		return INVALID_OFFSET, INVALID_OFFSET, ErrNotPrimary
+	}
+	first := part.Offset + 1
+	part.write(first, messages)
+	part.advance()
+	last := part.Offset
+	part.Unlock()
+
+	part.Commit(last)
+
+	return first, last, nil
+}
+
+/*
+ * 从副本按主副本分配的偏移追加消息, 偏移必须递增, 主副本压缩后可能不连续.
+ * 追加不等待同步, 调用者追加一批消息后调用 Commit.
+ */
+func (part *Partition) Append(id uint64, message []byte) error {
+	return part.AppendMessage(id, &Message{Body: message})
+}
+
+func (part *Partition) AppendMessage(id uint64, message *Message) error {
+
+	part.Lock()
+	defer part.Unlock()
+
+	if part.deleted {
+		return ErrUnknownPartition
+	}
+
+	if id <= part.Offset {
+		return ErrOffsetInvalid
+	}
+
+	part.write(id, []Message{*message})
+
+	return nil
 }
 
 func (part *Partition) Read(id uint64) []byte {
@@ -148,6 +344,10 @@ func (part *Partition) Read(id uint64) []byte {
 	part.RLock()
 	defer part.RUnlock()
 
+	if id > part.HighWater {
+		return nil
+	}
+
 	seg := part.seglist.Find(id)
 	if seg == nil {
 		return nil
@@ -156,6 +356,372 @@ func (part *Partition) Read(id uint64) []byte {
 	return seg.Read(id)
 }
 
+func (part *Partition) ReadRaw(id uint64) []byte {
+
+	part.RLock()
+	defer part.RUnlock()
+
+	seg := part.seglist.Find(id)
+	if seg == nil {
+		return nil
+	}
+
+	return seg.ReadRaw(id)
+}
+
+/* 偏移不小于 id 的第一条记录, 压缩删除的偏移被跳过 */
+func (part *Partition) ReadRawFrom(id uint64) (uint64, []byte) {
+
+	part.RLock()
+	defer part.RUnlock()
+
+	for _, seg := range part.seglist.array {
+		if seg.Empty() || seg.End() < id {
+			continue
+		}
+		cur, raw := seg.ReadRawFrom(id)
+		if raw != nil {
+			return cur, raw
+		}
+	}
+
+	return INVALID_OFFSET, nil
+}
+
+/* 日志起始偏移, 更早的消息已经按保留策略删除 */
+func (part *Partition) StartOffset() uint64 {
+	part.RLock()
+	defer part.RUnlock()
+
+	return part.seglist.First().Begin()
+}
+
+/* 段中最新消息的创建时间, 只有 v0 记录的段没有创建时间, 使用文件的修改时间 */
+func segmentTime(seg *Segment) time.Time {
+	maxTime := seg.MaxTime()
+	if maxTime == 0 {
+		return seg.ModTime()
+	}
+	return time.Unix(0, maxTime*int64(time.Millisecond))
+}
+
+/*
+ * 按保留策略从头删除整个段: 段中最新的消息超过 maxAge, 或者分区总大小超过 maxBytes.
+ * 正在写入的最后一个段和高水位之后的消息不删除. 返回删除的段数量.
+ */
+func (part *Partition) Retain(maxAge time.Duration, maxBytes int64) int {
+	part.cleanmu.Lock()
+	defer part.cleanmu.Unlock()
+
+	/* 持有 cleanmu 时已经提交的非活动段不会修改, 不持有分区锁读取记录的创建时间 */
+	part.RLock()
+	if part.deleted {
+		part.RUnlock()
+		return 0
+	}
+	segs := make(map[*Segment]time.Time, 0)
+	for _, seg := range part.seglist.array[:part.seglist.Len()-1] {
+		if seg.End() > part.HighWater {
+			break
+		}
+		segs[seg] = time.Time{}
+	}
+	part.RUnlock()
+
+	if maxAge > 0 {
+		for seg := range segs {
+			segs[seg] = segmentTime(seg)
+		}
+	}
+
+	part.Lock()
+	defer part.Unlock()
+
+	if part.deleted {
+		return 0
+	}
+
+	var total int64
+	for _, seg := range part.seglist.array {
+		total += seg.Size()
+	}
+
+	count := 0
+	for part.seglist.Len() > 1 {
+		first := part.seglist.First()
+		updated, b := segs[first]
+		if b == false || first.End() > part.HighWater {
+			break
+		}
+
+		expired := maxAge > 0 && time.Since(updated) > maxAge
+		oversize := maxBytes > 0 && total > maxBytes
+		if expired == false && oversize == false {
+			break
+		}
+
+		total -= first.Size()
+		part.seglist.Del()
+		count++
+	}
+
+	if count > 0 {
+		part.version++
+		log.Println("partition retention!", part.ID, count, part.seglist.First().Begin())
+	}
+
+	return count
+}
+
+/*
+ * 按 key 压缩已经提交的非活动段: 每个 key 只保留最新的一条记录, 没有 key 的记录都保留.
+ * 消息体为空的记录是墓碑, 表示删除这个 key, 从压缩第一次发现起超过 tombstone 后也删除,
+ * 不使用生产者填写的创建时间, 避免墓碑提前删除或者永远不删除.
+ * 只处理高水位以内写满的段, 这些段不再修改, 扫描和重写时不持有分区锁, 只在替换段时加锁.
+ * 最新记录也只按这些段计算, 活动段中的新记录在段写满后的下一次压缩中生效. 返回删除的记录数.
+ */
+func (part *Partition) Compact(tombstone time.Duration) int {
+	part.cleanmu.Lock()
+	defer part.cleanmu.Unlock()
+
+	part.RLock()
+	if part.deleted {
+		part.RUnlock()
+		return 0
+	}
+	segs := make([]*Segment, 0)
+	for _, seg := range part.seglist.array[:part.seglist.Len()-1] {
+		if seg.End() > part.HighWater {
+			break
+		}
+		segs = append(segs, seg)
+	}
+	part.RUnlock()
+
+	latest := make(map[string]uint64, 0)
+	for _, seg := range segs {
+		err := seg.Scan(func(rec *MsgRec, raw []byte) bool {
+			if rec.key != nil {
+				latest[string(rec.key)] = rec.offset
+			}
+			return true
+		})
+		if err != nil {
+			log.Println("partition compact failed!", part.ID, err.Error())
+			return 0
+		}
+	}
+
+	now := time.Now()
+	seen := make(map[uint64]time.Time, 0)
+	keep := func(rec *MsgRec) bool {
+		if rec.key == nil {
+			return true
+		}
+		if latest[string(rec.key)] != rec.offset {
+			return false
+		}
+		if len(rec.body) > 0 {
+			return true
+		}
+		first, b := part.tombstones[rec.offset]
+		if b == false {
+			first = now
+		}
+		if now.Sub(first) >= tombstone {
+			return false
+		}
+		seen[rec.offset] = first
+		return true
+	}
+
+	/* 持有 cleanmu 时段不会被删除, 写入只在末尾追加新段, 段在列表中的位置不变 */
+	count := 0
+	for i, seg := range segs {
+		cleaned, removed, err := seg.rewrite(keep)
+		if err != nil {
+			log.Println("segment compact failed!", part.ID, seg.Begin(), err.Error())
+			break
+		}
+		if cleaned == seg {
+			continue
+		}
+
+		part.Lock()
+		seg.replace(cleaned)
+		part.seglist.array[i] = cleaned
+		part.version++
+		part.Unlock()
+
+		count += removed
+	}
+
+	part.tombstones = seen
+
+	if count > 0 {
+		log.Println("partition compact!", part.ID, count)
+	}
+
+	return count
+}
+
+/* 从副本落后于主副本的起始偏移时, 丢弃本地所有消息, 从 start 开始复制 */
+func (part *Partition) ResetStart(start uint64) {
+	part.cleanmu.Lock()
+	defer part.cleanmu.Unlock()
+
+	part.Lock()
+	defer part.Unlock()
+
+	if part.deleted {
+		return
+	}
+
+	log.Println("partition reset start!", part.ID, part.Offset, start)
+	part.version++
+
+	part.seglist.Destory()
+	part.seglist.Add(NewSegment(part.DirPath, start))
+
+	part.Offset = offsetBefore(start)
+	if part.HighWater > part.Offset {
+		part.HighWater = part.Offset
+	}
+	part.synced = part.Offset
+}
+
+/* 删除 offset 之后的消息, 从副本切换主副本时截断到高水位, 丢弃未提交的消息 */
+func (part *Partition) Truncate(offset uint64) {
+	part.cleanmu.Lock()
+	defer part.cleanmu.Unlock()
+
+	part.Lock()
+	defer part.Unlock()
+
+	if part.deleted || offset >= part.Offset {
+		return
+	}
+
+	for len(part.seglist.array) > 1 && part.seglist.Last().Begin() > offset {
+		part.seglist.DelLast()
+	}
+
+	last := part.seglist.Last()
+	last.Truncate(offset)
+	if last.Begin() > offset+1 {
+		part.seglist.DelLast()
+		part.seglist.Add(NewSegment(part.DirPath, offset+1))
+	}
+
+	log.Println("partition truncate!", part.ID, part.Offset, offset)
+	part.version++
+
+	part.Offset = offset
+	if part.HighWater > offset {
+		part.HighWater = offset
+	}
+	if part.synced > offset {
+		part.synced = offset
+	}
+}
+
+/* 高水位取本地和同步从副本偏移的最小值, 只增不减 */
+func (part *Partition) advance() {
+	hw := part.Offset
+	for _, offset := range part.isr {
+		if offset < hw {
+			hw = offset
+		}
+	}
+	part.setHighWater(hw)
+}
+
+/* 高水位推进后唤醒所有等待者 */
+func (part *Partition) setHighWater(hw uint64) {
+	if hw <= part.HighWater {
+		return
+	}
+	part.HighWater = hw
+	close(part.hwnotify)
+	part.hwnotify = make(chan struct{})
+}
+
+func (part *Partition) HighWatermark() uint64 {
+	part.RLock()
+	defer part.RUnlock()
+
+	return part.HighWater
+}
+
+/* 从副本使用主副本返回的高水位, 不超过本地已经写入的偏移 */
+func (part *Partition) SetHighWatermark(hw uint64) {
+	part.Lock()
+	defer part.Unlock()
+
+	if hw > part.Offset {
+		hw = part.Offset
+	}
+	part.setHighWater(hw)
+}
+
+/* 等待高水位到达 offset, 超时返回 false */
+func (part *Partition) WaitHighWatermark(offset uint64, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		part.RLock()
+		hw, notify := part.HighWater, part.hwnotify
+		part.RUnlock()
+
+		if hw >= offset {
+			return true
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+/* 更新同步副本集合, 保留已知从副本的偏移 */
+func (part *Partition) SetSyncReplicas(replicas map[string]uint64) {
+	part.Lock()
+	defer part.Unlock()
+
+	isr := make(map[string]uint64, len(replicas))
+	for name, offset := range replicas {
+		if cur, b := part.isr[name]; b && cur > offset {
+			offset = cur
+		}
+		isr[name] = offset
+	}
+	part.isr = isr
+	part.advance()
+}
+
+/* 从副本拉取后更新其偏移, 只有同步副本会推进高水位 */
+func (part *Partition) ReplicaOffset(replica string, offset uint64) {
+	part.Lock()
+	defer part.Unlock()
+
+	cur, b := part.isr[replica]
+	if b == false || offset <= cur {
+		return
+	}
+	part.isr[replica] = offset
+	part.advance()
+}
+
+func (part *Partition) GetStatus() PART_S {
+	part.RLock()
+	defer part.RUnlock()
+
+	return part.Status
+}
+
 func (part *Partition) UpdateStatus(status PART_S) {
 	part.Lock()
 	defer part.Unlock()
@@ -163,15 +729,44 @@ func (part *Partition) UpdateStatus(status PART_S) {
 	part.Status = status
 }
 
+/* 删除所有段文件和分区目录 */
+func (part *Partition) Delete() {
+	part.cleanmu.Lock()
+	defer part.cleanmu.Unlock()
+
+	part.Lock()
+	defer part.Unlock()
+
+	part.stopSyncLoop()
+	part.seglist.Destory()
+	part.deleted = true
+	part.version++
+
+	err := os.RemoveAll(part.DirPath)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	part.Offset = 0
+	part.HighWater = 0
+	part.synced = 0
+}
+
 func (part *Partition) Reset() {
+	part.cleanmu.Lock()
+	defer part.cleanmu.Unlock()
+
 	part.Lock()
 	defer part.Unlock()
 
 	// 重置所有内容
 	if part.Offset != 0 {
 		part.Offset = 0
+		part.HighWater = 0
+		part.synced = 0
+		part.version++
 		part.seglist.Destory()
-		seg := NewSegment(part.DirPath, 0)
+		seg := NewSegment(part.DirPath, 1)
 		part.seglist.Add(seg)
 	}
 }
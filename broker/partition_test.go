@@ -1,8 +1,12 @@
 package broker
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"os"
+	"sync"
+	"time"
 
 	"testing"
 )
@@ -68,3 +72,561 @@ func TestPartition03(t *testing.T) {
 
 	log.Println("offset : ", part.CurOffset())
 }
+
+func TestPartition04(t *testing.T) {
+	part := NewPartition("0x987654321", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+
+	part.Reset()
+
+	for i := 0; i < 1000; i++ {
+		offset := part.Write([]byte(fmt.Sprintf("helloworld%d", i)))
+		if offset != uint64(i+1) {
+			t.Errorf("write offset %d invalid!", offset)
+			return
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		body := part.Read(uint64(i + 1))
+		if string(body) != fmt.Sprintf("helloworld%d", i) {
+			t.Errorf("read offset %d invalid! %s", i+1, body)
+			return
+		}
+	}
+
+	if part.Read(1001) != nil {
+		t.Errorf("read offset 1001 should be empty!")
+	}
+
+	part.Reset()
+}
+
+func TestPartition05(t *testing.T) {
+	part := NewPartition("0x192837465", PART_S_FOLLOW)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+
+	part.Reset()
+
+	for i := 1; i <= 100; i++ {
+		err := part.Append(uint64(i), []byte(fmt.Sprintf("helloworld%d", i)))
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+	}
+
+	if part.Append(100, []byte("helloworld")) != ErrOffsetInvalid {
+		t.Errorf("append duplicate offset should fail!")
+	}
+
+	/* 主副本压缩后偏移可以不连续 */
+	if part.Append(102, []byte("helloworld102")) != nil {
+		t.Errorf("append offset after gap should success!")
+	}
+
+	if part.Read(100) != nil {
+		t.Errorf("read above high watermark should be empty!")
+	}
+
+	part.SetHighWatermark(200)
+
+	if part.CurOffset() != 102 || string(part.Read(100)) != "helloworld100" || part.Read(101) != nil {
+		t.Errorf("append partition invalid! %d", part.CurOffset())
+	}
+
+	if id, raw := part.ReadRawFrom(101); id != 102 || raw == nil {
+		t.Errorf("read from gap should skip to next record! %d", id)
+	}
+
+	part.Reset()
+}
+
+func TestPartition06(t *testing.T) {
+	part := NewPartition("0x918273645", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+
+	part.Reset()
+
+	part.SetSyncReplicas(map[string]uint64{"broker1": 0, "broker2": 0})
+
+	for i := 0; i < 10; i++ {
+		part.Write([]byte(fmt.Sprintf("helloworld%d", i)))
+	}
+
+	if part.HighWatermark() != 0 || part.Read(1) != nil {
+		t.Errorf("high watermark %d should be 0!", part.HighWatermark())
+	}
+
+	part.ReplicaOffset("broker1", 10)
+	part.ReplicaOffset("broker2", 5)
+	part.ReplicaOffset("broker3", 1)
+
+	if part.HighWatermark() != 5 || part.Read(5) == nil || part.Read(6) != nil {
+		t.Errorf("high watermark %d should be 5!", part.HighWatermark())
+	}
+
+	part.SetSyncReplicas(map[string]uint64{"broker1": 0})
+
+	if part.HighWatermark() != 10 {
+		t.Errorf("high watermark %d should be 10!", part.HighWatermark())
+	}
+
+	part.Reset()
+}
+
+func TestPartition07(t *testing.T) {
+	part := NewPartition("0x564738291", PART_S_FOLLOW)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+
+	part.Reset()
+
+	for i := 1; i <= 100; i++ {
+		part.Append(uint64(i), []byte(fmt.Sprintf("helloworld%d", i)))
+	}
+	part.SetHighWatermark(100)
+
+	part.Truncate(60)
+
+	if part.CurOffset() != 60 || part.HighWatermark() != 60 || part.ReadRaw(61) != nil {
+		t.Errorf("truncate partition invalid! %d", part.CurOffset())
+		return
+	}
+
+	err := part.Append(61, []byte("helloworld61x"))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	part.SetHighWatermark(61)
+
+	if string(part.Read(60)) != "helloworld60" || string(part.Read(61)) != "helloworld61x" {
+		t.Errorf("read after truncate invalid!")
+	}
+
+	part.Truncate(0)
+
+	if part.CurOffset() != 0 || part.ReadRaw(1) != nil {
+		t.Errorf("truncate partition to empty invalid! %d", part.CurOffset())
+	}
+
+	part.Reset()
+}
+
+func TestPartition08(t *testing.T) {
+	part := NewPartition("0x675849302", PART_S_FOLLOW)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+
+	part.Append(part.CurOffset()+1, []byte("helloworld"))
+
+	part.Delete()
+
+	_, err := os.Stat(part.DirPath)
+	if os.IsNotExist(err) == false {
+		t.Errorf("partition path should be removed! %v", err)
+	}
+
+	if part.Append(1, []byte("helloworld")) != ErrUnknownPartition {
+		t.Errorf("append to deleted partition should fail!")
+	}
+}
+
+func TestPartition09(t *testing.T) {
+	part := NewPartition("0x918273645", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	defer part.Delete()
+
+	body := make([]byte, 512*1024)
+	for i := 0; i < 24; i++ {
+		part.Write(body)
+	}
+
+	segs := part.seglist.Len()
+	if segs < 3 {
+		t.Errorf("segment number %d is too small!", segs)
+		return
+	}
+
+	if part.StartOffset() != 1 {
+		t.Errorf("start offset %d should be 1!", part.StartOffset())
+	}
+
+	cnt := part.Retain(0, int64(SEGMENT_MAXSIZE))
+	if cnt == 0 || part.seglist.Len() != segs-cnt {
+		t.Errorf("retain by bytes failed! %d %d", cnt, part.seglist.Len())
+	}
+
+	start := part.StartOffset()
+	if start <= 1 || part.ReadRaw(start) == nil {
+		t.Errorf("start offset %d is invalid!", start)
+	}
+	if part.ReadRaw(start-1) != nil {
+		t.Errorf("offset %d should be removed!", start-1)
+	}
+
+	if part.Retain(time.Hour, 0) != 0 {
+		t.Errorf("young segment should not be removed!")
+	}
+
+	part.ResetStart(start + 100)
+	if part.StartOffset() != start+100 || part.CurOffset() != start+99 {
+		t.Errorf("reset start failed! %d %d", part.StartOffset(), part.CurOffset())
+	}
+}
+
+func TestPartition10(t *testing.T) {
+	part := NewPartition("0x192837465", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	defer part.Delete()
+
+	old := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	body := make([]byte, 256*1024)
+
+	/* key 循环写入, 然后写 k1 创建时间很早的墓碑和 k2 创建时间在将来的墓碑, 墓碑也落在旧段中 */
+	for i := 0; part.seglist.Len() < 3; i++ {
+		key := []byte(fmt.Sprintf("k%d", i%4))
+		part.WriteMessage(&Message{Key: key, Body: body})
+	}
+	part.WriteMessage(&Message{Body: []byte("nokey")})
+	part.WriteMessage(&Message{Key: []byte("k1"), Timestamp: old})
+	part.WriteMessage(&Message{Key: []byte("k2"), Timestamp: future})
+	for part.seglist.Len() < 4 {
+		part.WriteMessage(&Message{Body: body})
+	}
+
+	keys := func() map[string]int {
+		keys := make(map[string]int, 0)
+		for offset := uint64(1); ; {
+			id, raw := part.ReadRawFrom(offset)
+			if raw == nil {
+				break
+			}
+			rec, _ := DecodeMsgRec(raw)
+			if rec.offset <= part.seglist.array[part.seglist.Len()-2].End() {
+				keys[string(rec.key)]++
+			}
+			offset = id + 1
+		}
+		return keys
+	}
+
+	removed := part.Compact(10 * time.Minute)
+	if removed == 0 {
+		t.Fatalf("nothing compacted!")
+	}
+
+	/* 旧段中每个 key 只剩一条, 墓碑的保留时间从第一次压缩开始计算, 与创建时间无关 */
+	result := keys()
+	for key, cnt := range result {
+		if key != "" && cnt > 1 {
+			t.Errorf("key %s left %d records!", key, cnt)
+		}
+	}
+	if result["k1"] != 1 || result["k2"] != 1 || result["k0"] != 1 || result[""] == 0 {
+		t.Errorf("compact result is invalid! %v", result)
+	}
+
+	if part.Compact(10*time.Minute) != 0 {
+		t.Errorf("compact twice should remove nothing!")
+	}
+
+	/* 超过保留时间后两个墓碑都删除 */
+	for offset, first := range part.tombstones {
+		part.tombstones[offset] = first.Add(-time.Hour)
+	}
+	if part.Compact(10*time.Minute) != 2 {
+		t.Errorf("expired tombstones should be removed!")
+	}
+	result = keys()
+	if result["k1"] != 0 || result["k2"] != 0 || result["k0"] != 1 {
+		t.Errorf("compact result is invalid! %v", result)
+	}
+}
+
+func TestPartition11(t *testing.T) {
+	part := NewPartition("0x564738201", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	defer part.Delete()
+
+	if _, err := NewSyncPolicy("interval", 0, 0); err != ErrSyncPolicy {
+		t.Errorf("interval policy without interval should fail!")
+	}
+
+	/* 并发写入, 返回时消息已经同步 */
+	policy, _ := NewSyncPolicy("always", 0, 0)
+	part.SetSyncPolicy(policy)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				offset := part.Write([]byte("helloworld"))
+				if part.SyncedOffset() < offset {
+					t.Errorf("write return before sync! %d", offset)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	policy, _ = NewSyncPolicy("none", 0, 0)
+	part.SetSyncPolicy(policy)
+	offset := part.Write([]byte("helloworld"))
+	if part.SyncedOffset() >= offset {
+		t.Errorf("none policy should not sync!")
+	}
+
+	policy, _ = NewSyncPolicy("interval", 10*time.Millisecond, 0)
+	part.SetSyncPolicy(policy)
+	offset = part.Write([]byte("helloworld"))
+	time.Sleep(50 * time.Millisecond)
+	if part.SyncedOffset() != offset {
+		t.Errorf("interval policy should sync! %d %d", part.SyncedOffset(), offset)
+	}
+
+	policy, _ = NewSyncPolicy("bytes", 0, 1024)
+	part.SetSyncPolicy(policy)
+	offset = part.Write([]byte("helloworld"))
+	if part.SyncedOffset() >= offset {
+		t.Errorf("bytes policy should not sync below threshold!")
+	}
+	offset = part.Write(make([]byte, 1024))
+	if part.SyncedOffset() != offset {
+		t.Errorf("bytes policy should sync above threshold!")
+	}
+}
+
+func TestPartition12(t *testing.T) {
+	part := NewPartition("0x564738202", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	defer part.Delete()
+
+	if first, last := part.WriteBatch(nil); first != 0 || last != 0 {
+		t.Errorf("empty batch should write nothing! %d %d", first, last)
+	}
+
+	part.Write([]byte("helloworld"))
+
+	/* 一批消息跨越多个段 */
+	batch := make([][]byte, 0)
+	for i := 0; i < 20; i++ {
+		body := make([]byte, 512*1024)
+		copy(body, fmt.Sprintf("helloworld%d", i))
+		batch = append(batch, body)
+	}
+
+	first, last := part.WriteBatch(batch)
+	if first != 2 || last != 21 || part.CurOffset() != 21 {
+		t.Fatalf("write batch failed! %d %d", first, last)
+	}
+	if part.seglist.Len() < 3 {
+		t.Errorf("batch should roll segments! %d", part.seglist.Len())
+	}
+
+	for i := range batch {
+		body := part.Read(first + uint64(i))
+		if bytes.Equal(body, batch[i]) == false {
+			t.Errorf("read batch message %d failed!", first+uint64(i))
+		}
+	}
+
+	if first, last = part.WriteBatch([][]byte{[]byte("a"), []byte("b")}); first != 22 || last != 23 {
+		t.Errorf("write batch after roll failed! %d %d", first, last)
+	}
+}
+
+func TestPartition13(t *testing.T) {
+	part := NewPartition("0x564738203", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	defer part.Delete()
+
+	body := make([]byte, 256*1024)
+	for i := 0; part.seglist.Len() < 4; i++ {
+		part.WriteMessage(&Message{Key: []byte(fmt.Sprintf("k%d", i%4)), Body: body})
+	}
+
+	/* 压缩期间继续写入和读取, 不会被压缩阻塞 */
+	done := make(chan int)
+	go func() {
+		done <- part.Compact(time.Hour)
+	}()
+
+	for i := 0; i < 100; i++ {
+		part.WriteMessage(&Message{Key: []byte("k0"), Body: []byte("new")})
+		part.ReadRawFrom(1)
+	}
+
+	if <-done == 0 {
+		t.Errorf("nothing compacted!")
+	}
+
+	last := part.CurOffset()
+	if string(part.Read(last)) != "new" {
+		t.Errorf("read after compact failed! %d", last)
+	}
+}
+
+func TestPartition14(t *testing.T) {
+	part := NewPartition("0x1472583690", PART_S_FOLLOW)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+
+	messages := []Message{{Body: []byte("helloworld")}}
+
+	_, _, err := part.writePrimary(messages)
+	if err != ErrNotPrimary {
+		t.Errorf("follower write should fail! %v", err)
+		return
+	}
+
+	part.UpdateStatus(PART_S_PRIMARY)
+	first, last, err := part.writePrimary(messages)
+	if err != nil || first != 1 || last != 1 {
+		t.Errorf("primary write failed! %d %d %v", first, last, err)
+		return
+	}
+
+	/* 管理器查找到分区后分区被删除, 不能再写入 */
+	part.Delete()
+	_, _, err = part.writePrimary(messages)
+	if err != ErrUnknownPartition {
+		t.Errorf("deleted partition write should fail! %v", err)
+	}
+}
+
+func TestPartition15(t *testing.T) {
+	id := "0x1472583691"
+	path := WorkPath(id)
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	/* 旧版本创建的空分区: 第一个段从 0 开始, 没有任何消息 */
+	if err := MkDir(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	seg := NewSegment(path, 0)
+	seg.Close()
+
+	part := NewPartition(id, PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	if part.CurOffset() != 0 || part.HighWatermark() != 0 {
+		t.Errorf("empty partition offset invalid! %d %d", part.CurOffset(), part.HighWatermark())
+		return
+	}
+
+	offset := part.Write([]byte("helloworld"))
+	if offset != 1 || string(part.Read(1)) != "helloworld" {
+		t.Errorf("write empty partition failed! %d", offset)
+	}
+
+	part.ResetStart(0)
+	if part.CurOffset() != 0 {
+		t.Errorf("reset start offset invalid! %d", part.CurOffset())
+	}
+
+	part.Reset()
+}
+
+func TestPartition16(t *testing.T) {
+	msg := Message{Key: []byte("key"), Timestamp: 1, Headers: map[string]string{"a": "1", "bb": "22"}, Body: []byte("body")}
+	if msgRecSize(&msg) != int(NewMsgRec(1, &msg).size) {
+		t.Errorf("message record size invalid! %d %d", msgRecSize(&msg), NewMsgRec(1, &msg).size)
+	}
+
+	part := NewPartition("0x1472583692", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+
+	/* 超过段上限的消息写入后无法读取, 写入时拒绝 */
+	large := []Message{{Body: []byte("helloworld")}, {Body: make([]byte, SEGMENT_MAXSIZE)}}
+	_, _, err := part.writePrimary(large)
+	if err != ErrMessageTooLarge || part.CurOffset() != 0 {
+		t.Errorf("large message should be rejected! %v %d", err, part.CurOffset())
+	}
+
+	part.Reset()
+}
+
+func TestPartition17(t *testing.T) {
+	part := NewPartition("0x1472583693", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	defer part.Delete()
+
+	/* 旧消息按记录的创建时间过期, 与文件的修改时间无关 */
+	old := time.Now().Add(-2*time.Hour).UnixNano() / int64(time.Millisecond)
+	body := make([]byte, 512*1024)
+	for i := 0; i < 10; i++ {
+		part.WriteMessage(&Message{Timestamp: old, Body: body})
+	}
+	for i := 0; i < 10; i++ {
+		part.Write(body)
+	}
+
+	segs := part.seglist.Len()
+	if segs < 3 {
+		t.Errorf("segment number %d is too small!", segs)
+		return
+	}
+
+	if part.Retain(time.Hour, 0) == 0 {
+		t.Errorf("old segment should be removed!")
+	}
+	if part.Retain(time.Hour, 0) != 0 {
+		t.Errorf("young segment should not be removed!")
+	}
+
+	/* 重新打开后扫描记录得到相同的创建时间 */
+	first := part.seglist.First()
+	maxTime := first.MaxTime()
+	seg := NewSegment(part.DirPath, first.Begin())
+	if seg.MaxTime() != maxTime || maxTime <= old {
+		t.Errorf("segment max time invalid! %d %d", seg.MaxTime(), maxTime)
+	}
+	seg.Close()
+}
@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	PARTITIONER_VNODES = 64 /* 一致性哈希中每个分区的虚拟节点数量 */
+)
+
+var (
+	ErrPartitionKey = errors.New("partition key is invalid!")
+)
+
+/* 生产者根据消息的 key 从 topic 的分区列表中选择一个分区 */
+type Partitioner interface {
+	Partition(topic string, key []byte, partitions []string) (string, error)
+}
+
+/* 依次选择各个分区 */
+type RoundRobinPartitioner struct {
+	sync.Mutex
+	next map[string]int
+}
+
+func NewRoundRobinPartitioner() *RoundRobinPartitioner {
+	return &RoundRobinPartitioner{next: make(map[string]int, 0)}
+}
+
+func (p *RoundRobinPartitioner) Partition(topic string, key []byte, partitions []string) (string, error) {
+	if len(partitions) == 0 {
+		return "", ErrUnknownPartition
+	}
+
+	p.Lock()
+	idx := p.next[topic]
+	p.next[topic]++
+	p.Unlock()
+
+	return partitions[idx%len(partitions)], nil
+}
+
+/* 所有消息写入指定的分区, Target 为分区 ID 或者分区在 topic 中的序号, 不使用消息的 key */
+type ExplicitPartitioner struct {
+	Target string
+}
+
+func (p ExplicitPartitioner) Partition(topic string, key []byte, partitions []string) (string, error) {
+	if stringsHas(partitions, p.Target) {
+		return p.Target, nil
+	}
+
+	idx, err := strconv.Atoi(p.Target)
+	if err != nil {
+		return "", ErrPartitionKey
+	}
+	if idx < 0 || idx >= len(partitions) {
+		return "", ErrUnknownPartition
+	}
+
+	return partitions[idx], nil
+}
+
+type hashRing struct {
+	members string
+	hashes  []uint32
+	owners  map[uint32]string
+}
+
+func newHashRing(partitions []string) *hashRing {
+	ring := &hashRing{
+		members: strings.Join(partitions, ","),
+		owners:  make(map[uint32]string, len(partitions)*PARTITIONER_VNODES),
+	}
+
+	for _, id := range partitions {
+		for i := 0; i < PARTITIONER_VNODES; i++ {
+			hash := crc32.ChecksumIEEE([]byte(id + "#" + strconv.Itoa(i)))
+			if _, b := ring.owners[hash]; b {
+				continue
+			}
+			ring.owners[hash] = id
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+
+	return ring
+}
+
+func (ring *hashRing) get(key []byte) string {
+	hash := crc32.ChecksumIEEE(key)
+
+	idx := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+	if idx == len(ring.hashes) {
+		idx = 0
+	}
+	return ring.owners[ring.hashes[idx]]
+}
+
+/*
+ * 按 key 的一致性哈希选择分区, 同一个 key 的消息总是写入同一个分区, 保持顺序.
+ * topic 增加分区时只有少部分 key 换到新的分区. 没有 key 的消息依次写入各分区.
+ */
+type HashPartitioner struct {
+	sync.Mutex
+	rings map[string]*hashRing
+	none  *RoundRobinPartitioner
+}
+
+func NewHashPartitioner() *HashPartitioner {
+	return &HashPartitioner{
+		rings: make(map[string]*hashRing, 0),
+		none:  NewRoundRobinPartitioner(),
+	}
+}
+
+func (p *HashPartitioner) Partition(topic string, key []byte, partitions []string) (string, error) {
+	if len(key) == 0 {
+		return p.none.Partition(topic, key, partitions)
+	}
+	if len(partitions) == 0 {
+		return "", ErrUnknownPartition
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	ring, b := p.rings[topic]
+	if b == false || ring.members != strings.Join(partitions, ",") {
+		ring = newHashRing(partitions)
+		p.rings[topic] = ring
+	}
+
+	return ring.get(key), nil
+}
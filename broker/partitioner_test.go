@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPartitioner01(t *testing.T) {
+	partitions := []string{"p0", "p1", "p2", "p3"}
+	p := NewHashPartitioner()
+
+	owner := make(map[string]string, 0)
+	used := make(map[string]int, 0)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		id, err := p.Partition("orders", []byte(key), partitions)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		owner[key] = id
+		used[id]++
+	}
+	if len(used) != len(partitions) {
+		t.Errorf("keys should spread to all partitions! %v", used)
+	}
+
+	/* 增加分区后, 大部分 key 仍然在原来的分区 */
+	partitions = append(partitions, "p4")
+	moved := 0
+	for key, id := range owner {
+		newid, _ := p.Partition("orders", []byte(key), partitions)
+		if newid != id {
+			if newid != "p4" {
+				t.Errorf("key %s should move to new partition! %s -> %s", key, id, newid)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Errorf("moved keys %d invalid!", moved)
+	}
+}
+
+func TestPartitioner02(t *testing.T) {
+	partitions := []string{"p0", "p1", "p2"}
+
+	rr := NewRoundRobinPartitioner()
+	for i := 0; i < 6; i++ {
+		id, err := rr.Partition("orders", nil, partitions)
+		if err != nil || id != partitions[i%3] {
+			t.Errorf("round robin partition invalid! %d %s", i, id)
+		}
+	}
+
+	/* 消息的 key 不影响指定的分区 */
+	if id, err := (ExplicitPartitioner{Target: "p1"}).Partition("orders", []byte("2"), partitions); err != nil || id != "p1" {
+		t.Errorf("explicit partition by id invalid! %s", id)
+	}
+	if id, err := (ExplicitPartitioner{Target: "2"}).Partition("orders", []byte("p0"), partitions); err != nil || id != "p2" {
+		t.Errorf("explicit partition by index invalid! %s", id)
+	}
+	if _, err := (ExplicitPartitioner{Target: "3"}).Partition("orders", nil, partitions); err != ErrUnknownPartition {
+		t.Errorf("explicit partition out of range should fail!")
+	}
+	if _, err := (ExplicitPartitioner{Target: "px"}).Partition("orders", nil, partitions); err != ErrPartitionKey {
+		t.Errorf("explicit partition invalid target should fail!")
+	}
+}
+
+func TestPartitioner03(t *testing.T) {
+	r := new(router)
+	r.topics = map[string]DataTopic{"orders": {Topic: "orders", Partitions: []string{"p0", "p1", "p2"}}}
+
+	p := &Producer{Partitioner: NewHashPartitioner(), router: r}
+
+	messages := make([]Message, 0)
+	for i := 0; i < 30; i++ {
+		messages = append(messages, Message{Key: []byte(fmt.Sprintf("key%d", i%6))})
+	}
+	pending := make([]int, len(messages))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	/* 每条消息按各自的 key 分组, 同一个 key 的消息在同一组中并且保持顺序 */
+	order, groups, err := p.partition("orders", messages, pending, p.Partitioner)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(order) < 2 || len(order) != len(groups) {
+		t.Errorf("messages should spread to partitions! %v", order)
+	}
+
+	owner := make(map[string]string, 0)
+	for _, partitionId := range order {
+		last := -1
+		for _, i := range groups[partitionId] {
+			if i <= last {
+				t.Errorf("message order invalid in partition %s! %v", partitionId, groups[partitionId])
+			}
+			last = i
+			key := string(messages[i].Key)
+			if id, b := owner[key]; b && id != partitionId {
+				t.Errorf("key %s in two partitions! %s %s", key, id, partitionId)
+			}
+			owner[key] = partitionId
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package broker
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	PRODUCER_RETRY    = 3
+	PRODUCER_RETRYGAP = 500 * time.Millisecond
+	PRODUCER_TIMEOUT  = 5 * time.Second
+)
+
+/*
+ * Acks 为确认级别, Timeout 为 acks=all 时等待同步副本写入的超时,
+ * Partitioner 根据消息的 key 选择分区, 默认按 key 的一致性哈希.
+ */
+type Producer struct {
+	ProducerID  string
+	Acks        ACKS
+	Timeout     time.Duration
+	Partitioner Partitioner
+
+	router *router
+}
+
+func NewProducer(etcds []string) (*Producer, error) {
+	p := new(Producer)
+	p.ProducerID = UUID(UUID64)
+	p.Acks = ACKS_PRIMARY
+	p.Timeout = PRODUCER_TIMEOUT
+	p.Partitioner = NewHashPartitioner()
+
+	router, err := newRouter(p.ProducerID, etcds)
+	if err != nil {
+		return nil, err
+	}
+	p.router = router
+
+	return p, nil
+}
+
+func (p *Producer) Close() {
+	p.router.close()
+}
+
+/* 按 key 把消息分到各个分区, 分区按第一次出现的顺序排列, 同一分区内保持原来的顺序 */
+func (p *Producer) partition(topic string, messages []Message, pending []int, partitioner Partitioner) ([]string, map[string][]int, error) {
+	partitions, err := p.router.topicPartitions(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order := make([]string, 0)
+	groups := make(map[string][]int, 0)
+
+	for _, i := range pending {
+		partitionId, err := partitioner.Partition(topic, messages[i].Key, partitions)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, b := groups[partitionId]; b == false {
+			order = append(order, partitionId)
+		}
+		groups[partitionId] = append(groups[partitionId], i)
+	}
+
+	return order, groups, nil
+}
+
+func (p *Producer) produce(partitionId string, messages []Message, list []int, offsets []uint64) error {
+	client, err := p.router.routePartition(partitionId)
+	if err != nil {
+		p.router.invalid(nil)
+		return err
+	}
+
+	batch := make([]Message, 0, len(list))
+	for _, i := range list {
+		batch = append(batch, messages[i])
+	}
+
+	result, err := client.ProduceMessages(partitionId, batch, p.Acks, p.Timeout)
+	if err != nil {
+		if err != ErrAckTimeout {
+			p.router.invalid(client)
+		}
+		return err
+	}
+
+	for j, i := range list {
+		offsets[i] = result[j]
+	}
+	return nil
+}
+
+/*
+ * 每条消息按各自的 key 选择分区, 每个分区发送一批, 返回的偏移与 messages 一一对应.
+ * 失败的分区重新选择分区后重试, 最终失败时返回错误, 这时其他分区的消息可能已经写入.
+ */
+func (p *Producer) SendMessages(topic string, messages []Message) ([]uint64, error) {
+	return p.send(topic, messages, p.Partitioner)
+}
+
+/* 不经过 Partitioner, 直接写入 partition 指定的分区, partition 为分区 ID 或者分区在 topic 中的序号 */
+func (p *Producer) SendPartition(topic string, partition string, messages []Message) ([]uint64, error) {
+	return p.send(topic, messages, ExplicitPartitioner{Target: partition})
+}
+
+func (p *Producer) send(topic string, messages []Message, partitioner Partitioner) ([]uint64, error) {
+	var err error
+
+	offsets := make([]uint64, len(messages))
+	pending := make([]int, len(messages))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for i := 0; i < PRODUCER_RETRY && len(pending) > 0; i++ {
+		if i > 0 {
+			time.Sleep(PRODUCER_RETRYGAP)
+		}
+
+		order, groups, perr := p.partition(topic, messages, pending, partitioner)
+		if perr == ErrTopicNotExist || perr == ErrPartitionKey {
+			return nil, perr
+		}
+		if perr != nil {
+			err = perr
+			log.Println("producer route failed!", topic, err.Error())
+			p.router.invalid(nil)
+			continue
+		}
+
+		failed := make([]int, 0)
+		for _, partitionId := range order {
+			serr := p.produce(partitionId, messages, groups[partitionId], offsets)
+			/* 主副本已经写入, 重试会导致消息重复 */
+			if serr == ErrAckTimeout {
+				return nil, serr
+			}
+			if serr != nil {
+				err = serr
+				log.Println("producer send failed!", topic, partitionId, err.Error())
+				failed = append(failed, groups[partitionId]...)
+			}
+		}
+		pending = failed
+	}
+
+	if len(pending) > 0 {
+		return nil, err
+	}
+
+	return offsets, nil
+}
+
+func (p *Producer) SendMessage(topic string, message Message) (uint64, error) {
+	offsets, err := p.SendMessages(topic, []Message{message})
+	if err != nil {
+		return INVALID_OFFSET, err
+	}
+	return offsets[0], nil
+}
+
+func (p *Producer) SendBatchKey(topic string, key []byte, messages [][]byte) ([]uint64, error) {
+	list := make([]Message, 0, len(messages))
+	for _, v := range messages {
+		list = append(list, Message{Key: key, Body: v})
+	}
+	return p.SendMessages(topic, list)
+}
+
+func (p *Producer) SendBatch(topic string, messages [][]byte) ([]uint64, error) {
+	return p.SendBatchKey(topic, nil, messages)
+}
+
+func (p *Producer) SendKey(topic string, key []byte, message []byte) (uint64, error) {
+	return p.SendMessage(topic, Message{Key: key, Body: message})
+}
+
+func (p *Producer) Send(topic string, message []byte) (uint64, error) {
+	return p.SendKey(topic, nil, message)
+}
@@ -0,0 +1,637 @@
+package broker
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+ * 报文格式 (大端序):
+ *   请求: size(4) | apikey(2) | version(2) | correlation(4) | clientid(str) | body
+ *   应答: size(4) | correlation(4) | errcode(2) | body
+ * str = len(2) + data, bytes = len(4) + data
+ * size 不包含自身的4个字节
+ * 报文体按请求头中的版本号编解码, 高版本只在末尾追加字段
+ */
+
+type API_KEY uint16
+
+const (
+	_ API_KEY = iota
+	API_PRODUCE
+	API_FETCH
+	API_METADATA
+	API_OFFSET_COMMIT
+)
+
+/* 各接口当前支持的最大版本号 */
+var apiVersions = map[API_KEY]uint16{
+	API_PRODUCE:       2,
+	API_FETCH:         4,
+	API_METADATA:      1,
+	API_OFFSET_COMMIT: 1,
+}
+
+type ERR_CODE uint16
+
+const (
+	ERR_NONE ERR_CODE = iota
+	ERR_UNKNOWN
+	ERR_BAD_REQUEST
+	ERR_UNSUPPORTED_API
+	ERR_UNSUPPORTED_VERSION
+	ERR_UNKNOWN_PARTITION
+	ERR_NOT_PRIMARY
+	ERR_ACK_TIMEOUT
+	ERR_OFFSET_OUT_OF_RANGE
+	ERR_ACKS_INVALID
+	ERR_MESSAGE_TOO_LARGE
+	ERR_NOT_REPLICA
+)
+
+/* 生产消息的确认级别 */
+type ACKS int16
+
+const (
+	ACKS_NONE    ACKS = 0  /* 不等待应答 */
+	ACKS_PRIMARY ACKS = 1  /* 主副本写入后应答 */
+	ACKS_ALL     ACKS = -1 /* 同步副本集合都写入后应答 */
+)
+
+const (
+	FRAME_MAXSIZE = 16 * 1024 * 1024
+)
+
+var (
+	ErrNoMessage          = errors.New("message is not exist!")
+	ErrFrameSize          = errors.New("frame size is invalid!")
+	ErrBadRequest         = errors.New("request is invalid!")
+	ErrUnsupportedApi     = errors.New("api is not supported!")
+	ErrUnsupportedVersion = errors.New("api version is not supported!")
+	ErrUnknownPartition   = errors.New("partition is not exist!")
+	ErrNotPrimary         = errors.New("partition is not primary!")
+	ErrAckTimeout         = errors.New("wait replicas ack timeout!")
+	ErrAcksInvalid        = errors.New("acks is invalid!")
+	ErrOffsetOutOfRange   = errors.New("offset is out of range!")
+	ErrMessageTooLarge    = errors.New("message is too large!")
+	ErrNotReplica         = errors.New("broker is not replica of partition!")
+)
+
+var errCodes = map[ERR_CODE]error{
+	ERR_BAD_REQUEST:         ErrBadRequest,
+	ERR_UNSUPPORTED_API:     ErrUnsupportedApi,
+	ERR_UNSUPPORTED_VERSION: ErrUnsupportedVersion,
+	ERR_UNKNOWN_PARTITION:   ErrUnknownPartition,
+	ERR_NOT_PRIMARY:         ErrNotPrimary,
+	ERR_ACK_TIMEOUT:         ErrAckTimeout,
+	ERR_OFFSET_OUT_OF_RANGE: ErrOffsetOutOfRange,
+	ERR_ACKS_INVALID:        ErrAcksInvalid,
+	ERR_MESSAGE_TOO_LARGE:   ErrMessageTooLarge,
+	ERR_NOT_REPLICA:         ErrNotReplica,
+}
+
+/* 解析 "0", "1", "all" 三种确认级别 */
+func ParseAcks(s string) (ACKS, error) {
+	switch s {
+	case "0":
+		return ACKS_NONE, nil
+	case "1":
+		return ACKS_PRIMARY, nil
+	case "all", "-1":
+		return ACKS_ALL, nil
+	}
+	return ACKS_PRIMARY, ErrAcksInvalid
+}
+
+func (a ACKS) Valid() bool {
+	return a == ACKS_NONE || a == ACKS_PRIMARY || a == ACKS_ALL
+}
+
+func errToCode(err error) ERR_CODE {
+	if err == nil {
+		return ERR_NONE
+	}
+	for code, v := range errCodes {
+		if v == err {
+			return code
+		}
+	}
+	return ERR_UNKNOWN
+}
+
+func codeToErr(code ERR_CODE, msg string) error {
+	if code == ERR_NONE {
+		return nil
+	}
+	err, b := errCodes[code]
+	if b {
+		return err
+	}
+	return errors.New(msg)
+}
+
+type encoder struct {
+	buf     []byte
+	version uint16
+}
+
+func (e *encoder) PutUint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) PutUint16(v uint16) {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], v)
+	e.buf = append(e.buf, tmp[:]...)
+}
+
+func (e *encoder) PutUint32(v uint32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	e.buf = append(e.buf, tmp[:]...)
+}
+
+func (e *encoder) PutUint64(v uint64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	e.buf = append(e.buf, tmp[:]...)
+}
+
+func (e *encoder) PutString(s string) {
+	e.PutUint16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) PutBytes(b []byte) {
+	e.PutUint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) PutStrings(list []string) {
+	e.PutUint32(uint32(len(list)))
+	for _, v := range list {
+		e.PutString(v)
+	}
+}
+
+type decoder struct {
+	buf     []byte
+	err     error
+	version uint16
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = ErrBadRequest
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) Uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) Uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) Uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) Uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) String() string {
+	return string(d.next(int(d.Uint16())))
+}
+
+func (d *decoder) Bytes() []byte {
+	b := d.next(int(d.Uint32()))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+/* 列表长度至少占用一个字节, 防止异常报文申请超大内存 */
+func (d *decoder) Count() int {
+	cnt := int(d.Uint32())
+	if d.err == nil && cnt > len(d.buf) {
+		d.err = ErrBadRequest
+		return 0
+	}
+	return cnt
+}
+
+func (d *decoder) Strings() []string {
+	cnt := d.Count()
+	list := make([]string, 0, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		list = append(list, d.String())
+	}
+	return list
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var head [4]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(head[:])
+	if size > FRAME_MAXSIZE {
+		return nil, ErrFrameSize
+	}
+
+	frame := make([]byte, size)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	if len(frame) > FRAME_MAXSIZE {
+		return ErrFrameSize
+	}
+
+	var head [4]byte
+	binary.BigEndian.PutUint32(head[:], uint32(len(frame)))
+
+	_, err := w.Write(head[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+type ReqHeader struct {
+	ApiKey        API_KEY
+	ApiVersion    uint16
+	CorrelationID uint32
+	ClientID      string
+}
+
+func (h *ReqHeader) encode(e *encoder) {
+	e.PutUint16(uint16(h.ApiKey))
+	e.PutUint16(h.ApiVersion)
+	e.PutUint32(h.CorrelationID)
+	e.PutString(h.ClientID)
+}
+
+func (h *ReqHeader) decode(d *decoder) {
+	h.ApiKey = API_KEY(d.Uint16())
+	h.ApiVersion = d.Uint16()
+	h.CorrelationID = d.Uint32()
+	h.ClientID = d.String()
+}
+
+type RspHeader struct {
+	CorrelationID uint32
+	ErrCode       ERR_CODE
+}
+
+func (h *RspHeader) encode(e *encoder) {
+	e.PutUint32(h.CorrelationID)
+	e.PutUint16(uint16(h.ErrCode))
+}
+
+func (h *RspHeader) decode(d *decoder) {
+	h.CorrelationID = d.Uint32()
+	h.ErrCode = ERR_CODE(d.Uint16())
+}
+
+type message interface {
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+/*
+ * v1: 增加确认级别和等待超时 (毫秒), acks=0 时服务端不回应答
+ * v2: 增加每条消息的 key、创建时间和 headers, Messages 中的 Offset 不使用
+ */
+type ProduceReq struct {
+	PartitionID string
+	Messages    []Message
+	Acks        ACKS
+	Timeout     uint32
+}
+
+func (r *ProduceReq) encode(e *encoder) {
+	e.PutString(r.PartitionID)
+	e.PutUint32(uint32(len(r.Messages)))
+	for _, v := range r.Messages {
+		e.PutBytes(v.Body)
+	}
+	if e.version >= 1 {
+		e.PutUint16(uint16(r.Acks))
+		e.PutUint32(r.Timeout)
+	}
+	if e.version >= 2 {
+		for _, v := range r.Messages {
+			e.PutBytes(v.Key)
+			e.PutUint64(uint64(v.Timestamp))
+			e.PutUint32(uint32(len(v.Headers)))
+			for name, value := range v.Headers {
+				e.PutString(name)
+				e.PutBytes([]byte(value))
+			}
+		}
+	}
+}
+
+func (r *ProduceReq) decode(d *decoder) {
+	r.PartitionID = d.String()
+	cnt := d.Count()
+	r.Messages = make([]Message, 0, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		r.Messages = append(r.Messages, Message{Body: d.Bytes()})
+	}
+	r.Acks = ACKS_PRIMARY
+	if d.version >= 1 {
+		r.Acks = ACKS(d.Uint16())
+		r.Timeout = d.Uint32()
+	}
+	if d.version >= 2 {
+		for i := range r.Messages {
+			msg := &r.Messages[i]
+			if key := d.Bytes(); len(key) > 0 {
+				msg.Key = key
+			}
+			msg.Timestamp = int64(d.Uint64())
+			num := d.Count()
+			if num > 0 {
+				msg.Headers = make(map[string]string, num)
+			}
+			for j := 0; j < num && d.err == nil; j++ {
+				name := d.String()
+				msg.Headers[name] = string(d.Bytes())
+			}
+		}
+	}
+}
+
+type ProduceRsp struct {
+	Offsets []uint64
+}
+
+func (r *ProduceRsp) encode(e *encoder) {
+	e.PutUint32(uint32(len(r.Offsets)))
+	for _, v := range r.Offsets {
+		e.PutUint64(v)
+	}
+}
+
+func (r *ProduceRsp) decode(d *decoder) {
+	cnt := d.Count()
+	r.Offsets = make([]uint64, 0, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		r.Offsets = append(r.Offsets, d.Uint64())
+	}
+}
+
+/*
+ * v1: ReplicaID 不为空表示从副本复制请求, 不受高水位限制
+ * v2: RecordVersion 为客户端支持的最高记录版本, 更高版本的记录转换为 v0 后返回
+ * v4: 报文不变, 消费者请求的偏移已经被清理时不返回错误, 返回空的记录和日志起始偏移
+ */
+type FetchReq struct {
+	PartitionID   string
+	Offset        uint64
+	MaxCount      uint32
+	MaxBytes      uint32
+	ReplicaID     string
+	RecordVersion uint8
+
+	version uint16
+}
+
+func (r *FetchReq) encode(e *encoder) {
+	e.PutString(r.PartitionID)
+	e.PutUint64(r.Offset)
+	e.PutUint32(r.MaxCount)
+	e.PutUint32(r.MaxBytes)
+	if e.version >= 1 {
+		e.PutString(r.ReplicaID)
+	}
+	if e.version >= 2 {
+		e.PutUint8(r.RecordVersion)
+	}
+}
+
+func (r *FetchReq) decode(d *decoder) {
+	r.version = d.version
+	r.PartitionID = d.String()
+	r.Offset = d.Uint64()
+	r.MaxCount = d.Uint32()
+	r.MaxBytes = d.Uint32()
+	if d.version >= 1 {
+		r.ReplicaID = d.String()
+	}
+	if d.version >= 2 {
+		r.RecordVersion = d.Uint8()
+	}
+}
+
+/*
+ * Records 中每条记录与日志文件中的 MsgRec 编码一致, v1 增加主副本的高水位,
+ * v3 增加日志起始偏移, 从副本或者消费者落后于起始偏移时从起始偏移重新读取
+ */
+type FetchRsp struct {
+	Records   [][]byte
+	HighWater uint64
+	LogStart  uint64
+}
+
+func (r *FetchRsp) encode(e *encoder) {
+	e.PutUint32(uint32(len(r.Records)))
+	for _, v := range r.Records {
+		e.PutBytes(v)
+	}
+	if e.version >= 1 {
+		e.PutUint64(r.HighWater)
+	}
+	if e.version >= 3 {
+		e.PutUint64(r.LogStart)
+	}
+}
+
+func (r *FetchRsp) decode(d *decoder) {
+	cnt := d.Count()
+	r.Records = make([][]byte, 0, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		r.Records = append(r.Records, d.Bytes())
+	}
+	if d.version >= 1 {
+		r.HighWater = d.Uint64()
+	}
+	if d.version >= 3 {
+		r.LogStart = d.Uint64()
+	}
+}
+
+type MetadataReq struct {
+	Topics []string
+}
+
+func (r *MetadataReq) encode(e *encoder) {
+	e.PutStrings(r.Topics)
+}
+
+func (r *MetadataReq) decode(d *decoder) {
+	r.Topics = d.Strings()
+}
+
+type MetadataRsp struct {
+	Brokers    []DataBroker
+	Topics     []DataTopic
+	Partitions []DataPartition
+}
+
+func (r *MetadataRsp) encode(e *encoder) {
+	e.PutUint32(uint32(len(r.Brokers)))
+	for _, v := range r.Brokers {
+		e.PutString(v.Broker)
+		e.PutString(v.Addr)
+	}
+
+	e.PutUint32(uint32(len(r.Topics)))
+	for _, v := range r.Topics {
+		e.PutString(v.Topic)
+		/* v0 的 topic 只有一个分区, 只填写第一个 */
+		var partitionId string
+		if len(v.Partitions) > 0 {
+			partitionId = v.Partitions[0]
+		}
+		e.PutString(partitionId)
+	}
+
+	e.PutUint32(uint32(len(r.Partitions)))
+	for _, v := range r.Partitions {
+		e.PutString(v.PartitionID)
+		e.PutUint8(uint8(v.Status))
+		e.PutString(v.Topic)
+		e.PutUint32(uint32(len(v.Replicas)))
+		for _, rep := range v.Replicas {
+			e.PutString(rep.Broker)
+			e.PutUint8(uint8(rep.Role))
+		}
+	}
+
+	/* v1: 每个 topic 的全部分区 */
+	if e.version >= 1 {
+		for _, v := range r.Topics {
+			e.PutStrings(v.Partitions)
+		}
+	}
+}
+
+func (r *MetadataRsp) decode(d *decoder) {
+	cnt := d.Count()
+	r.Brokers = make([]DataBroker, 0, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		var v DataBroker
+		v.Broker = d.String()
+		v.Addr = d.String()
+		r.Brokers = append(r.Brokers, v)
+	}
+
+	cnt = d.Count()
+	r.Topics = make([]DataTopic, 0, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		var v DataTopic
+		v.Topic = d.String()
+		if partitionId := d.String(); partitionId != "" {
+			v.Partitions = []string{partitionId}
+		}
+		r.Topics = append(r.Topics, v)
+	}
+
+	cnt = d.Count()
+	r.Partitions = make([]DataPartition, 0, cnt)
+	for i := 0; i < cnt && d.err == nil; i++ {
+		var v DataPartition
+		v.PartitionID = d.String()
+		v.Status = PART_S(d.Uint8())
+		v.Topic = d.String()
+		num := d.Count()
+		v.Replicas = make([]PartReplicas, 0, num)
+		for j := 0; j < num && d.err == nil; j++ {
+			var rep PartReplicas
+			rep.Broker = d.String()
+			rep.Role = PART_S(d.Uint8())
+			v.Replicas = append(v.Replicas, rep)
+		}
+		r.Partitions = append(r.Partitions, v)
+	}
+
+	if d.version >= 1 {
+		for i := range r.Topics {
+			r.Topics[i].Partitions = d.Strings()
+		}
+	}
+}
+
+/* v1: 增加 PartitionID, 按分区记录偏移; v0 请求按 topic 记录 */
+type OffsetCommitReq struct {
+	ConsumerID  string
+	Topic       string
+	Offset      uint64
+	PartitionID string
+}
+
+func (r *OffsetCommitReq) encode(e *encoder) {
+	e.PutString(r.ConsumerID)
+	e.PutString(r.Topic)
+	e.PutUint64(r.Offset)
+	if e.version >= 1 {
+		e.PutString(r.PartitionID)
+	}
+}
+
+func (r *OffsetCommitReq) decode(d *decoder) {
+	r.ConsumerID = d.String()
+	r.Topic = d.String()
+	r.Offset = d.Uint64()
+	if d.version >= 1 {
+		r.PartitionID = d.String()
+	}
+}
+
+type OffsetCommitRsp struct {
+}
+
+func (r *OffsetCommitRsp) encode(e *encoder) {
+}
+
+func (r *OffsetCommitRsp) decode(d *decoder) {
+}
@@ -6,25 +6,28 @@ import (
 	"log"
 )
 
-func BrokerPublicGet(etcdconn *EtcdConn) *DataCommon {
+/*
+ * 读取 etcd 的列表接口在 etcd 异常时返回错误, 请求处理和后台协程记录日志后重试,
+ * 不能因为 etcd 的一次超时退出进程.
+ */
+func BrokerPublicGet(etcdconn *EtcdConn) (*DataCommon, error) {
 
 	datacomm := new(DataCommon)
 
 	value, err := etcdconn.Get(KEY_COMMON)
 	if err != nil {
 		if err == ErrIsNone {
-			return datacomm
+			return datacomm, nil
 		}
-		log.Fatalln(err.Error())
+		return nil, err
 	}
 
 	err = json.Unmarshal(value, datacomm)
 	if err != nil {
-		log.Fatalln(err.Error())
-		return datacomm
+		return nil, err
 	}
 
-	return datacomm
+	return datacomm, nil
 }
 
 func BrokerPublicPut(etcdconn *EtcdConn, cfg DataCommon) error {
@@ -35,16 +38,16 @@ func BrokerPublicPut(etcdconn *EtcdConn, cfg DataCommon) error {
 	return etcdconn.Put(KEY_COMMON, value)
 }
 
-func BrokerServerGet(etcdconn *EtcdConn) []DataBroker {
+func BrokerServerGet(etcdconn *EtcdConn) ([]DataBroker, error) {
 
 	brokerlist := make([]DataBroker, 0)
 
 	keylist, err := etcdconn.GetAll(KEY_BROKER)
 	if err != nil {
 		if err == ErrIsNone {
-			return brokerlist
+			return brokerlist, nil
 		}
-		log.Fatalln(err.Error())
+		return nil, err
 	}
 
 	for _, v := range keylist {
@@ -57,19 +60,19 @@ func BrokerServerGet(etcdconn *EtcdConn) []DataBroker {
 		brokerlist = append(brokerlist, broker)
 	}
 
-	return brokerlist
+	return brokerlist, nil
 }
 
-func BrokerTopicGet(etcdconn *EtcdConn) []DataTopic {
+func BrokerTopicGet(etcdconn *EtcdConn) ([]DataTopic, error) {
 
 	topiclist := make([]DataTopic, 0)
 
 	keylist, err := etcdconn.GetAll(KEY_TOPIC)
 	if err != nil {
 		if err == ErrIsNone {
-			return topiclist
+			return topiclist, nil
 		}
-		log.Fatalln(err.Error())
+		return nil, err
 	}
 
 	for _, v := range keylist {
@@ -82,7 +85,23 @@ func BrokerTopicGet(etcdconn *EtcdConn) []DataTopic {
 		topiclist = append(topiclist, topic)
 	}
 
-	return topiclist
+	return topiclist, nil
+}
+
+func BrokerTopicFind(etcdconn *EtcdConn, name string) (*DataTopic, error) {
+
+	value, err := etcdconn.Get(KEY_TOPIC + name)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := new(DataTopic)
+	err = json.Unmarshal(value, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return topic, nil
 }
 
 func BrokerTopicPut(etcdconn *EtcdConn, topic DataTopic) error {
@@ -97,6 +116,29 @@ func BrokerTopicPut(etcdconn *EtcdConn, topic DataTopic) error {
 	return etcdconn.Put(key, value)
 }
 
+/* topic 不存在时才写入 */
+func BrokerTopicCreate(etcdconn *EtcdConn, topic DataTopic) error {
+
+	value, err := json.Marshal(topic)
+	if err != nil {
+		return err
+	}
+
+	succ, err := etcdconn.CompareAndPut(KEY_TOPIC+topic.Topic, value, 0)
+	if err != nil {
+		return err
+	}
+	if succ == false {
+		return ErrTopicExist
+	}
+
+	return nil
+}
+
+func BrokerTopicDelete(etcdconn *EtcdConn, name string) error {
+	return etcdconn.Delete(KEY_TOPIC + name)
+}
+
 func BrokerPartitionPut(etcdconn *EtcdConn, partition DataPartition) error {
 
 	value, err := json.Marshal(partition)
@@ -109,16 +151,56 @@ func BrokerPartitionPut(etcdconn *EtcdConn, partition DataPartition) error {
 	return etcdconn.Put(key, value)
 }
 
-func BrokerPartitionGet(etcdconn *EtcdConn) []DataPartition {
+/* 以 CAS 方式修改分区记录, update 返回 false 表示不需要修改, 分区不存在时返回 ErrIsNone */
+func BrokerPartitionUpdate(etcdconn *EtcdConn, partitionId string, update func(partition *DataPartition) bool) error {
+
+	key := KEY_PARTITION + partitionId
+
+	for {
+		value, modrev, err := etcdconn.GetRevision(key)
+		if err != nil {
+			return err
+		}
+
+		var partition DataPartition
+		err = json.Unmarshal(value, &partition)
+		if err != nil {
+			return err
+		}
+
+		if update(&partition) == false {
+			return nil
+		}
+
+		value, err = json.Marshal(partition)
+		if err != nil {
+			return err
+		}
+
+		succ, err := etcdconn.CompareAndPut(key, value, modrev)
+		if err != nil {
+			return err
+		}
+		if succ {
+			return nil
+		}
+	}
+}
+
+func BrokerPartitionDelete(etcdconn *EtcdConn, partitionId string) error {
+	return etcdconn.Delete(KEY_PARTITION + partitionId)
+}
+
+func BrokerPartitionGet(etcdconn *EtcdConn) ([]DataPartition, error) {
 
 	partitionlist := make([]DataPartition, 0)
 
 	keylist, err := etcdconn.GetAll(KEY_PARTITION)
 	if err != nil {
 		if err == ErrIsNone {
-			return partitionlist
+			return partitionlist, nil
 		}
-		log.Fatalln(err.Error())
+		return nil, err
 	}
 
 	for _, v := range keylist {
@@ -131,12 +213,19 @@ func BrokerPartitionGet(etcdconn *EtcdConn) []DataPartition {
 		partitionlist = append(partitionlist, partition)
 	}
 
-	return partitionlist
+	return partitionlist, nil
+}
+
+/* 分区记录的变化, Deleted 表示分区记录已经删除 */
+type PartitionEvent struct {
+	DataPartition
+	Deleted bool
 }
 
-func BrokerPartitionWatch(ctx context.Context, etcdconn *EtcdConn) <-chan DataPartition {
+/* 监听结束时关闭 channel, ctx 没有取消时由调用者重新监听, 期间的变化需要重新读取分区列表 */
+func BrokerPartitionWatch(ctx context.Context, etcdconn *EtcdConn) <-chan PartitionEvent {
 
-	partitionChan := make(chan DataPartition, 10)
+	partitionChan := make(chan PartitionEvent, 10)
 
 	kvlist := etcdconn.Watch(ctx, KEY_PARTITION)
 
@@ -156,11 +245,24 @@ func BrokerPartitionWatch(ctx context.Context, etcdconn *EtcdConn) <-chan DataPa
 						log.Println(err.Error())
 						continue
 					}
-					partitionChan <- partition
+					partitionChan <- PartitionEvent{DataPartition: partition}
+				}
+			case EVENT_DELETE:
+				{
+					var partition DataPartition
+					err := json.Unmarshal([]byte(event.Value), &partition)
+					if err != nil {
+						log.Println(err.Error())
+						continue
+					}
+					partitionChan <- PartitionEvent{DataPartition: partition, Deleted: true}
 				}
 			case EVENT_EXIT:
 				{
-					log.Fatalln("watch partition failed!")
+					if ctx.Err() == nil {
+						log.Println("watch partition failed!")
+					}
+					close(partitionChan)
 					return
 				}
 			default:
@@ -173,3 +275,176 @@ func BrokerPartitionWatch(ctx context.Context, etcdconn *EtcdConn) <-chan DataPa
 
 	return partitionChan
 }
+
+func BrokerReassignPut(etcdconn *EtcdConn, reassign DataReassign) error {
+
+	value, err := json.Marshal(reassign)
+	if err != nil {
+		return err
+	}
+
+	return etcdconn.Put(KEY_REASSIGN+reassign.PartitionID, value)
+}
+
+func BrokerReassignGet(etcdconn *EtcdConn) (map[string]DataReassign, error) {
+
+	reassigns := make(map[string]DataReassign, 0)
+
+	keylist, err := etcdconn.GetAll(KEY_REASSIGN)
+	if err != nil {
+		if err == ErrIsNone {
+			return reassigns, nil
+		}
+		return nil, err
+	}
+
+	for _, v := range keylist {
+		var reassign DataReassign
+		err := json.Unmarshal([]byte(v.Value), &reassign)
+		if err != nil {
+			log.Println(err.Error(), v.Key, v.Value)
+			continue
+		}
+		reassigns[reassign.PartitionID] = reassign
+	}
+
+	return reassigns, nil
+}
+
+func BrokerReassignDelete(etcdconn *EtcdConn, partitionId string) error {
+	return etcdconn.Delete(KEY_REASSIGN + partitionId)
+}
+
+func BrokerDecommissionPut(etcdconn *EtcdConn, broker string) error {
+	return etcdconn.Put(KEY_DECOMMISSION+broker, []byte(broker))
+}
+
+func BrokerDecommissionGet(etcdconn *EtcdConn) (map[string]bool, error) {
+
+	brokers := make(map[string]bool, 0)
+
+	keylist, err := etcdconn.GetAll(KEY_DECOMMISSION)
+	if err != nil {
+		if err == ErrIsNone {
+			return brokers, nil
+		}
+		return nil, err
+	}
+
+	for _, v := range keylist {
+		brokers[v.Value] = true
+	}
+
+	return brokers, nil
+}
+
+func BrokerDecommissionDelete(etcdconn *EtcdConn, broker string) error {
+	return etcdconn.Delete(KEY_DECOMMISSION + broker)
+}
+
+func BrokerConsumerGet(etcdconn *EtcdConn, consumerId string) (*DataConsumer, error) {
+
+	consumer := &DataConsumer{ConsumerID: consumerId, Subs: make([]DataSubscribe, 0)}
+
+	value, err := etcdconn.Get(KEY_CONSUMER + consumerId)
+	if err != nil {
+		if err == ErrIsNone {
+			return consumer, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(value, consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	return consumer, nil
+}
+
+func BrokerConsumerPut(etcdconn *EtcdConn, consumer DataConsumer) error {
+
+	value, err := json.Marshal(consumer)
+	if err != nil {
+		return err
+	}
+
+	key := KEY_CONSUMER + consumer.ConsumerID
+
+	return etcdconn.Put(key, value)
+}
+
+/* 以 CAS 方式更新消费者记录, 多个组成员并发提交时不会互相覆盖 */
+func BrokerConsumerUpdate(etcdconn *EtcdConn, consumerId string, update func(consumer *DataConsumer)) error {
+
+	key := KEY_CONSUMER + consumerId
+
+	for {
+		consumer := &DataConsumer{ConsumerID: consumerId, Subs: make([]DataSubscribe, 0)}
+
+		value, modrev, err := etcdconn.GetRevision(key)
+		if err != nil && err != ErrIsNone {
+			return err
+		}
+
+		if err == nil {
+			err = json.Unmarshal(value, consumer)
+			if err != nil {
+				return err
+			}
+		}
+
+		update(consumer)
+
+		value, err = json.Marshal(consumer)
+		if err != nil {
+			return err
+		}
+
+		succ, err := etcdconn.CompareAndPut(key, value, modrev)
+		if err != nil {
+			return err
+		}
+		if succ {
+			return nil
+		}
+	}
+}
+
+/* 优先返回分区的记录, 没有时返回旧版本按 topic 提交的记录 */
+func (consumer *DataConsumer) Find(topic string, partitionId string) *DataSubscribe {
+	var legacy *DataSubscribe
+	for i := range consumer.Subs {
+		sub := &consumer.Subs[i]
+		if sub.Topic != topic {
+			continue
+		}
+		if sub.PartitionID == partitionId {
+			return sub
+		}
+		if sub.PartitionID == "" && legacy == nil {
+			legacy = sub
+		}
+	}
+	return legacy
+}
+
+/* 只修改这个分区自己的记录, 旧版本按 topic 的记录留给还没有提交过的分区使用 */
+func (consumer *DataConsumer) Update(topic string, partitionId string, offset uint64) {
+	for i := range consumer.Subs {
+		sub := &consumer.Subs[i]
+		if sub.Topic == topic && sub.PartitionID == partitionId {
+			sub.Offset = offset
+			return
+		}
+	}
+	consumer.Subs = append(consumer.Subs,
+		DataSubscribe{Topic: topic, PartitionID: partitionId, Offset: offset})
+}
+
+/* 按分区记录偏移, partitionId 为空时是旧版本客户端按 topic 提交 */
+func BrokerOffsetCommit(etcdconn *EtcdConn, consumerId string, topic string, partitionId string, offset uint64) error {
+	return BrokerConsumerUpdate(etcdconn, consumerId, func(consumer *DataConsumer) {
+		consumer.Update(topic, partitionId, offset)
+	})
+}
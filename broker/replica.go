@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	REPLICA_FETCHCOUNT = 1000
+	REPLICA_FETCHWAIT  = 100 * time.Millisecond
+	REPLICA_RETRYWAIT  = time.Second
+)
+
+/* 从副本持续从主副本拉取消息, 按相同的偏移追加到本地分区 */
+type replicaFetcher struct {
+	partition *Partition
+	client    *BrokerClient
+	primary   string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newReplicaFetcher(part *Partition) *replicaFetcher {
+	f := new(replicaFetcher)
+	f.partition = part
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+
+	log.Println("replica fetcher start!", part.ID)
+
+	go f.run()
+
+	return f
+}
+
+func (f *replicaFetcher) stop() {
+	f.cancel()
+	log.Println("replica fetcher stop!", f.partition.ID)
+}
+
+func (f *replicaFetcher) wait(d time.Duration) {
+	select {
+	case <-f.ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func (f *replicaFetcher) close() {
+	if f.client != nil {
+		f.client.Close()
+		f.client = nil
+	}
+}
+
+/*
+ * 找到主副本所在 broker 的地址, 主副本变化后重新建立连接.
+ * 高水位之后的消息可能没有复制到新的主副本, 切换时先截断到高水位再复制.
+ */
+func (f *replicaFetcher) connect() error {
+	primary := gPartitionMng.Primary(f.partition.ID)
+	if primary == "" {
+		return ErrNoPrimary
+	}
+
+	if f.client != nil && f.primary == primary {
+		return nil
+	}
+	f.close()
+
+	if gEtcd == nil {
+		return ErrNoEtcd
+	}
+
+	brokers, err := BrokerServerGet(gEtcd)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range brokers {
+		if v.Broker != primary {
+			continue
+		}
+
+		client, err := NewBrokerClient(v.Addr)
+		if err != nil {
+			return err
+		}
+		client.ClientID = gPartitionMng.BrokerName
+
+		if f.primary != primary {
+			f.partition.Truncate(f.partition.HighWatermark())
+		}
+
+		f.client = client
+		f.primary = primary
+		return nil
+	}
+
+	return ErrBrokerNotExist
+}
+
+func (f *replicaFetcher) fetch() (int, error) {
+	err := f.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	offset := f.partition.CurOffset() + 1
+
+	messages, hw, start, err := f.client.ReplicaFetch(f.partition.ID, gPartitionMng.BrokerName, offset, REPLICA_FETCHCOUNT)
+	if err != nil {
+		f.close()
+		return 0, err
+	}
+
+	/* 主副本已经按保留策略删除了需要的消息 */
+	if offset < start {
+		f.partition.ResetStart(start)
+		return 0, nil
+	}
+
+	for i, v := range messages {
+		err = f.partition.AppendMessage(v.Offset, &messages[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	/* 一批消息共用一次同步, 下一次拉取时主副本才认为这些消息已经复制 */
+	if len(messages) > 0 {
+		f.partition.Commit(messages[len(messages)-1].Offset)
+	}
+
+	f.partition.SetHighWatermark(hw)
+
+	return len(messages), nil
+}
+
+func (f *replicaFetcher) run() {
+	defer f.close()
+
+	for f.ctx.Err() == nil {
+		cnt, err := f.fetch()
+		if err != nil {
+			log.Println("replica fetch failed!", f.partition.ID, err.Error())
+			f.wait(REPLICA_RETRYWAIT)
+			continue
+		}
+		if cnt == 0 {
+			f.wait(REPLICA_FETCHWAIT)
+		}
+	}
+}
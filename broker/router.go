@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTopicNotExist  = errors.New("topic is not exist!")
+	ErrTopicExist     = errors.New("topic is already exist!")
+	ErrNoPrimary      = errors.New("partition primary is not exist!")
+	ErrBrokerNotExist = errors.New("broker is not exist!")
+)
+
+/* 生产者和消费者共用的路由表, 根据 etcd 中的 topic/partition/broker 找到主副本连接 */
+type router struct {
+	sync.Mutex
+
+	clientId   string
+	etcdconn   *EtcdConn
+	topics     map[string]DataTopic
+	partitions map[string]DataPartition
+	brokers    map[string]DataBroker
+	clients    map[string]*BrokerClient
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newRouter(clientId string, etcds []string) (*router, error) {
+	etcdconn, err := NewEtcdClient(etcds)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(router)
+	r.clientId = clientId
+	r.etcdconn = etcdconn
+	r.clients = make(map[string]*BrokerClient, 0)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	r.Lock()
+	err = r.refresh()
+	r.Unlock()
+	if err != nil {
+		etcdconn.Close()
+		return nil, err
+	}
+
+	go r.watch()
+
+	return r, nil
+}
+
+func (r *router) close() {
+	r.cancel()
+
+	r.Lock()
+	for name, client := range r.clients {
+		client.Close()
+		delete(r.clients, name)
+	}
+	r.Unlock()
+
+	r.etcdconn.Close()
+}
+
+/* 监听中断后重新监听, 并重新加载路由信息补上中断期间的变化 */
+func (r *router) watch() {
+	for r.ctx.Err() == nil {
+		for event := range BrokerPartitionWatch(r.ctx, r.etcdconn) {
+			r.Lock()
+			if event.Deleted {
+				delete(r.partitions, event.PartitionID)
+				delete(r.topics, event.Topic)
+			} else {
+				r.partitions[event.PartitionID] = event.DataPartition
+			}
+			r.Unlock()
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		r.invalid(nil)
+	}
+}
+
+/* 读取失败时保留原来的路由信息, 下一次请求失败时再重新加载 */
+func (r *router) refresh() error {
+	topiclist, err := BrokerTopicGet(r.etcdconn)
+	if err != nil {
+		return err
+	}
+	partitionlist, err := BrokerPartitionGet(r.etcdconn)
+	if err != nil {
+		return err
+	}
+	brokerlist, err := BrokerServerGet(r.etcdconn)
+	if err != nil {
+		return err
+	}
+
+	r.topics = make(map[string]DataTopic, 0)
+	for _, v := range topiclist {
+		r.topics[v.Topic] = v
+	}
+
+	r.partitions = make(map[string]DataPartition, 0)
+	for _, v := range partitionlist {
+		r.partitions[v.PartitionID] = v
+	}
+
+	r.brokers = make(map[string]DataBroker, 0)
+	for _, v := range brokerlist {
+		r.brokers[v.Broker] = v
+	}
+
+	return nil
+}
+
+func (r *router) topic(name string) (DataTopic, error) {
+	topic, b := r.topics[name]
+	if b {
+		return topic, nil
+	}
+
+	find, err := BrokerTopicFind(r.etcdconn, name)
+	if err != nil {
+		if err == ErrIsNone {
+			return topic, ErrTopicNotExist
+		}
+		return topic, err
+	}
+
+	r.topics[name] = *find
+	return *find, nil
+}
+
+func (r *router) client(partitionId string) (*BrokerClient, error) {
+	partition, b := r.partitions[partitionId]
+	if b == false {
+		return nil, ErrUnknownPartition
+	}
+
+	var primary string
+	for _, rep := range partition.Replicas {
+		if rep.Role == PART_S_PRIMARY {
+			primary = rep.Broker
+		}
+	}
+	if primary == "" {
+		return nil, ErrNoPrimary
+	}
+
+	client, b := r.clients[primary]
+	if b {
+		return client, nil
+	}
+
+	broker, b := r.brokers[primary]
+	if b == false {
+		return nil, ErrBrokerNotExist
+	}
+
+	client, err := NewBrokerClient(broker.Addr)
+	if err != nil {
+		return nil, err
+	}
+	client.ClientID = r.clientId
+
+	r.clients[primary] = client
+	return client, nil
+}
+
+func (r *router) routePartition(partitionId string) (*BrokerClient, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.client(partitionId)
+}
+
+func (r *router) topicPartitions(topic string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	datatopic, err := r.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return datatopic.Partitions, nil
+}
+
+/* 请求失败后断开连接并重新加载路由信息 */
+func (r *router) invalid(client *BrokerClient) {
+	r.Lock()
+	defer r.Unlock()
+
+	if client != nil {
+		for name, v := range r.clients {
+			if v == client {
+				delete(r.clients, name)
+			}
+		}
+		client.Close()
+	}
+
+	err := r.refresh()
+	if err != nil {
+		log.Println("router refresh failed!", err.Error())
+	}
+}
@@ -1,87 +1,241 @@
 package broker
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"hash/crc64"
 	"io"
 	"log"
 	"os"
+	"sort"
+	"time"
 
 	"encoding/binary"
 )
 
 var (
 	SEGMENT_MAXSIZE  = 1024 * 1024 * 4 // 当个文件最大4MB
-	SEGMENT_SYNCSIZE = 4 * 1024
-	SEGMENT_SYNCCNT  = 100
+	SEGMENT_SYNCSIZE = 4 * 1024        // 默认落盘策略, 每写入 4KB 同步一次
+)
+
+/*
+ * 记录格式: crc(8) | size(8) | offset(8) | payload
+ * v0 的 payload 为消息体. v1 在 size 的最高字节记录版本号, payload 为
+ * timestamp(8) | key(4+n) | headers 数量(4) + [name(2+n) value(4+n)]... | 消息体
+ * crc 覆盖 payload、offset 和包含版本号的 size, 读取时两种格式都支持.
+ */
+const (
+	MSGREC_HEADSIZE = 24
+	MSGREC_V0       = 0
+	MSGREC_V1       = 1
+	MSGREC_VERSHIFT = 56
+	MSGREC_SIZEMASK = 1<<MSGREC_VERSHIFT - 1
 )
 
 var (
-	ErrIsFull = errors.New("semgent is full!")
+	ErrIsFull    = errors.New("semgent is full!")
+	ErrBadRecord = errors.New("msg record is invalid!")
 )
 
 type MsgRec struct {
-	crc64  uint64
-	size   uint64
-	offset uint64
-	body   []byte
+	crc64   uint64
+	size    uint64 /* payload 的长度, 不包含版本号 */
+	offset  uint64
+	version uint8
+
+	timestamp int64
+	key       []byte
+	headers   map[string]string
+	body      []byte
 }
 
-type MsgIdx struct {
-	offset uint64
-}
+/*
+ * 索引格式: v0 每条 8 字节, 只有记录在日志文件中的位置, 不能可靠地推出记录的偏移
+ * (旧版本第一个段的起始偏移为 0, 第一条记录的偏移为 1).
+ * v1 文件头为 8 字节魔数, 每条 16 字节: offset(8) | 位置(8), 按偏移二分查找,
+ * 压缩后偏移可以不连续. 新建的索引文件使用 v1, 打开段时 v0 索引按日志中的偏移重建为 v1.
+ */
+const (
+	MSGIDX_V0       = 0
+	MSGIDX_V1       = 1
+	MSGIDX_MAGIC    = 0x4d5347494458ff01
+	MSGIDX_HEADSIZE = 8
+)
 
 type MsgIdxFile struct {
 	fileFd   *os.File
 	maxIdx   uint64
-	writecnt int
 	filename string
+	version  uint8
+	start    uint64 /* 段的起始偏移, 偏移连续时按它直接定位 */
 }
 
 type MsgRecFile struct {
-	fileFd    *os.File
-	curSize   int64
-	writeSize int64
-	isFull    bool
-	filename  string
+	fileFd   *os.File
+	curSize  int64
+	isFull   bool
+	filename string
 }
 
 type Segment struct {
-	idx *MsgIdxFile
-	log *MsgRecFile
+	idx  *MsgIdxFile
+	log  *MsgRecFile
+	path string
+
+	recovery SegmentRecovery /* 打开时崩溃恢复的结果 */
 
 	recnum uint64 //记录数量
 	start  uint64 //起始偏移
 	end    uint64 //结束偏移
+
+	maxTime   int64 /* 记录的最大创建时间, 毫秒 */
+	timeKnown bool  /* 打开已有记录的段时还不知道, 第一次使用时扫描 */
 }
 
-func (rec *MsgRec) CrcCheck() bool {
+/* 生成 v1 格式的记录 */
+func NewMsgRec(id uint64, msg *Message) *MsgRec {
+	rec := &MsgRec{
+		offset:    id,
+		version:   MSGREC_V1,
+		timestamp: msg.Timestamp,
+		key:       msg.Key,
+		headers:   msg.Headers,
+		body:      msg.Body,
+	}
+	rec.size = uint64(len(rec.payload()))
+	rec.CrcSum()
+	return rec
+}
+
+func msgCrc(offset uint64, size uint64, payload []byte) uint64 {
 	var buffer [16]byte
-	binary.BigEndian.PutUint64(buffer[:], rec.offset)
-	binary.BigEndian.PutUint64(buffer[8:], rec.size)
+	binary.BigEndian.PutUint64(buffer[:], offset)
+	binary.BigEndian.PutUint64(buffer[8:], size)
 
 	crctab := crc64.New(crc64.MakeTable(crc64.ISO))
-	crctab.Write(rec.body)
+	crctab.Write(payload)
 	crctab.Write(buffer[:])
 
-	if rec.crc64 == crctab.Sum64() {
-		return true
-	} else {
-		return false
+	return crctab.Sum64()
+}
+
+func (rec *MsgRec) sizeField() uint64 {
+	return uint64(rec.version)<<MSGREC_VERSHIFT | rec.size
+}
+
+/* headers 按名字排序编码, 同样的内容编码结果相同 */
+func (rec *MsgRec) payload() []byte {
+	if rec.version == MSGREC_V0 {
+		return rec.body
+	}
+
+	names := make([]string, 0, len(rec.headers))
+	for name := range rec.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e := &encoder{buf: make([]byte, 0, 16+len(rec.key)+len(rec.body))}
+	e.PutUint64(uint64(rec.timestamp))
+	e.PutBytes(rec.key)
+	e.PutUint32(uint32(len(names)))
+	for _, name := range names {
+		e.PutString(name)
+		e.PutBytes([]byte(rec.headers[name]))
+	}
+	return append(e.buf, rec.body...)
+}
+
+/* 消息按 v1 格式编码后的记录体长度, 与 payload 的编码保持一致 */
+func msgRecSize(msg *Message) int {
+	size := 8 + 4 + len(msg.Key) + 4 + len(msg.Body)
+	for name, value := range msg.Headers {
+		size += 2 + len(name) + 4 + len(value)
+	}
+	return size
+}
+
+func (rec *MsgRec) parsePayload(payload []byte) error {
+	if rec.version == MSGREC_V0 {
+		rec.body = payload
+		return nil
+	}
+	if rec.version != MSGREC_V1 {
+		return ErrBadRecord
+	}
+
+	d := &decoder{buf: payload}
+	rec.timestamp = int64(d.Uint64())
+	if key := d.next(int(d.Uint32())); len(key) > 0 {
+		rec.key = key
+	}
+	cnt := d.Count()
+	if cnt > 0 {
+		rec.headers = make(map[string]string, cnt)
+	}
+	for i := 0; i < cnt && d.err == nil; i++ {
+		name := d.String()
+		rec.headers[name] = string(d.next(int(d.Uint32())))
 	}
+	if d.err != nil {
+		return ErrBadRecord
+	}
+	rec.body = d.buf
+
+	return nil
+}
+
+func (rec *MsgRec) CrcCheck() bool {
+	return rec.crc64 == msgCrc(rec.offset, rec.sizeField(), rec.payload())
 }
 
 func (rec *MsgRec) CrcSum() {
-	var buffer [16]byte
-	binary.BigEndian.PutUint64(buffer[:], rec.offset)
-	binary.BigEndian.PutUint64(buffer[8:], rec.size)
+	rec.crc64 = msgCrc(rec.offset, rec.sizeField(), rec.payload())
+}
 
-	crctab := crc64.New(crc64.MakeTable(crc64.ISO))
-	crctab.Write(rec.body)
-	crctab.Write(buffer[:])
+func (rec *MsgRec) Encode() []byte {
+	payload := rec.payload()
+	buffer := make([]byte, MSGREC_HEADSIZE+len(payload))
+	binary.BigEndian.PutUint64(buffer[:], rec.crc64)
+	binary.BigEndian.PutUint64(buffer[8:], rec.sizeField())
+	binary.BigEndian.PutUint64(buffer[16:], rec.offset)
+	copy(buffer[MSGREC_HEADSIZE:], payload)
+	return buffer
+}
+
+func (rec *MsgRec) Message() Message {
+	return Message{Offset: rec.offset, Key: rec.key, Timestamp: rec.timestamp, Headers: rec.headers, Body: rec.body}
+}
+
+func DecodeMsgRec(buffer []byte) (*MsgRec, error) {
+	if len(buffer) < MSGREC_HEADSIZE {
+		return nil, ErrBadRecord
+	}
+
+	msgrec := new(MsgRec)
+	msgrec.crc64 = binary.BigEndian.Uint64(buffer[:])
+	size := binary.BigEndian.Uint64(buffer[8:])
+	msgrec.offset = binary.BigEndian.Uint64(buffer[16:])
 
-	rec.crc64 = crctab.Sum64()
+	msgrec.version = uint8(size >> MSGREC_VERSHIFT)
+	msgrec.size = size & MSGREC_SIZEMASK
+
+	if uint64(len(buffer)-MSGREC_HEADSIZE) != msgrec.size {
+		return nil, ErrBadRecord
+	}
+	payload := buffer[MSGREC_HEADSIZE:]
+
+	if msgrec.crc64 != msgCrc(msgrec.offset, size, payload) {
+		return nil, ErrBadRecord
+	}
+
+	err := msgrec.parsePayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return msgrec, nil
 }
 
 func openfile(filename string) (*os.File, error) {
@@ -112,9 +266,11 @@ func getfilesize(fd *os.File) uint64 {
 	return uint64(fileinfo.Size())
 }
 
-func NewMsgIdxFile(filename string) *MsgIdxFile {
+/* v0 的第一条索引总是 0, 和 v1 的魔数不会冲突 */
+func NewMsgIdxFile(filename string, start uint64) *MsgIdxFile {
 	idx := new(MsgIdxFile)
 	idx.filename = filename
+	idx.start = start
 	fd, err := openfile(filename)
 	if err != nil {
 		log.Println(err.Error())
@@ -122,20 +278,73 @@ func NewMsgIdxFile(filename string) *MsgIdxFile {
 	}
 	idx.fileFd = fd
 	filesize := getfilesize(fd)
-	idx.maxIdx = filesize / 8
+
+	var magic [MSGIDX_HEADSIZE]byte
+	if filesize >= MSGIDX_HEADSIZE {
+		_, err = fd.ReadAt(magic[:], 0)
+		if err != nil {
+			log.Println(err.Error())
+			fd.Close()
+			return nil
+		}
+	}
+
+	if filesize >= MSGIDX_HEADSIZE && binary.BigEndian.Uint64(magic[:]) != MSGIDX_MAGIC {
+		idx.version = MSGIDX_V0
+	} else {
+		idx.version = MSGIDX_V1
+		if filesize < MSGIDX_HEADSIZE {
+			binary.BigEndian.PutUint64(magic[:], MSGIDX_MAGIC)
+			_, err = fd.WriteAt(magic[:], 0)
+			if err != nil {
+				log.Println(err.Error())
+				fd.Close()
+				return nil
+			}
+			filesize = MSGIDX_HEADSIZE
+		}
+	}
+
+	idx.maxIdx = (filesize - idx.headSize()) / idx.entrySize()
 	return idx
 }
 
-func (idx *MsgIdxFile) Put(offset uint64) {
-	var buffer [8]byte
-	binary.BigEndian.PutUint64(buffer[:], offset)
+func (idx *MsgIdxFile) headSize() uint64 {
+	if idx.version == MSGIDX_V0 {
+		return 0
+	}
+	return MSGIDX_HEADSIZE
+}
+
+func (idx *MsgIdxFile) entrySize() uint64 {
+	if idx.version == MSGIDX_V0 {
+		return 8
+	}
+	return 16
+}
+
+/* 记录偏移为 id 的消息在日志文件中的位置, id 必须递增 */
+func (idx *MsgIdxFile) Put(id uint64, position uint64) {
+	idx.PutBatch([]uint64{id}, []uint64{position})
+}
+
+/* 多条索引编码后一次写入 */
+func (idx *MsgIdxFile) PutBatch(ids []uint64, positions []uint64) {
+	size := idx.entrySize()
+	buffer := make([]byte, uint64(len(ids))*size)
 
-	_, err := idx.fileFd.Seek(int64(idx.maxIdx*8), 0)
+	for i := range ids {
+		entry := buffer[uint64(i)*size:]
+		binary.BigEndian.PutUint64(entry, ids[i])
+		binary.BigEndian.PutUint64(entry[8:], positions[i])
+	}
+
+	_, err := idx.fileFd.Seek(int64(idx.Size()), 0)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	cnt, err := idx.fileFd.Write(buffer[:])
+	cnt, err := idx.fileFd.Write(buffer)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -144,79 +353,99 @@ func (idx *MsgIdxFile) Put(offset uint64) {
 		log.Fatalf("write msg index(%v) failed!", idx)
 	}
 
-	idx.writecnt++
-	if idx.writecnt > SEGMENT_SYNCCNT {
-		idx.fileFd.Sync()
-		idx.writecnt = 0
-	}
-
-	idx.maxIdx++
+	idx.maxIdx += uint64(len(ids))
 }
 
-func (idx *MsgIdxFile) Get(index uint64) uint64 {
-	if idx.maxIdx < index {
-		return INVALID_OFFSET
+/* 第 index 条索引的消息偏移和位置 */
+func (idx *MsgIdxFile) Get(index uint64) (id uint64, position uint64) {
+	if index >= idx.maxIdx {
+		return INVALID_OFFSET, INVALID_OFFSET
 	}
-	_, err := idx.fileFd.Seek(int64(index*8), 0)
+
+	var buffer [16]byte
+	entry := buffer[:idx.entrySize()]
+
+	_, err := idx.fileFd.ReadAt(entry, int64(idx.headSize()+index*idx.entrySize()))
 	if err != nil {
-		log.Println(err.Error())
-		return INVALID_OFFSET
+		log.Println("read index failed!", index, err.Error())
+		return INVALID_OFFSET, INVALID_OFFSET
 	}
-	var buffer [8]byte
 
-	cnt, err := idx.fileFd.Read(buffer[:])
-	if err != nil {
-		log.Println(err.Error())
-		return INVALID_OFFSET
+	return binary.BigEndian.Uint64(entry), binary.BigEndian.Uint64(entry[8:])
+}
+
+/* 第一条偏移不小于 id 的索引, 没有时返回 Max() */
+func (idx *MsgIdxFile) Search(id uint64) uint64 {
+	if id <= idx.start {
+		return 0
 	}
-	if cnt != len(buffer) {
-		log.Println("read index failed!", index)
-		return INVALID_OFFSET
+
+	/* 没有压缩过的段偏移连续, 直接命中 */
+	index := id - idx.start
+	if index < idx.maxIdx {
+		if cur, _ := idx.Get(index); cur == id {
+			return index
+		}
 	}
 
-	return binary.BigEndian.Uint64(buffer[:])
+	return uint64(sort.Search(int(idx.maxIdx), func(i int) bool {
+		cur, _ := idx.Get(uint64(i))
+		return cur >= id
+	}))
+}
+
+/* 偏移为 id 的消息在日志文件中的位置, 不存在时返回 INVALID_OFFSET */
+func (idx *MsgIdxFile) Find(id uint64) uint64 {
+	index := idx.Search(id)
+	cur, position := idx.Get(index)
+	if cur != id {
+		return INVALID_OFFSET
+	}
+	return position
 }
 
 func (idx *MsgIdxFile) Max() uint64 {
 	return idx.maxIdx
 }
 
-func (idx *MsgIdxFile) Reset() {
-	idx.maxIdx = 0
+/* 索引文件的大小 */
+func (idx *MsgIdxFile) Size() uint64 {
+	return idx.headSize() + idx.maxIdx*idx.entrySize()
 }
 
-func (idx *MsgIdxFile) Del() {
-	idx.fileFd.Close()
-	err := os.Remove(idx.filename)
+/* 清空 v0 索引并写入 v1 文件头, 之后由调用者按日志重新写入. 中途崩溃时重新打开会按空索引重建 */
+func (idx *MsgIdxFile) upgrade() {
+	err := idx.fileFd.Truncate(0)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-}
-
-func getmsgbody(rd io.Reader, size int) []byte {
 
-	var buffer [128]byte
-	var rdsize = 0
+	var magic [MSGIDX_HEADSIZE]byte
+	binary.BigEndian.PutUint64(magic[:], MSGIDX_MAGIC)
+	_, err = idx.fileFd.WriteAt(magic[:], 0)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 
-	body := make([]byte, size)
-	for {
-		cnt, err := rd.Read(buffer[:])
-		if err != nil {
-			log.Println(err.Error())
-			return nil
-		}
-		if cnt > (size - rdsize) {
-			cnt = (size - rdsize)
-		}
-		copy(body[rdsize:], buffer[:cnt])
+	idx.version = MSGIDX_V1
+	idx.maxIdx = 0
+}
 
-		rdsize += cnt
-		if rdsize >= size {
-			break
-		}
+/* 只保留前 num 条索引 */
+func (idx *MsgIdxFile) Truncate(num uint64) {
+	err := idx.fileFd.Truncate(int64(idx.headSize() + num*idx.entrySize()))
+	if err != nil {
+		log.Fatalln(err.Error())
 	}
+	idx.maxIdx = num
+}
 
-	return body
+func (idx *MsgIdxFile) Del() {
+	idx.fileFd.Close()
+	err := os.Remove(idx.filename)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
 }
 
 func NewMsgRecFile(filename string) *MsgRecFile {
@@ -239,56 +468,39 @@ func (rec *MsgRecFile) Full() bool {
 	return rec.isFull
 }
 
-func (rec *MsgRecFile) Reset() {
-	rec.isFull = false
-	rec.curSize = 0
-	rec.writeSize = 0
+func (rec *MsgRecFile) Truncate(size uint64) {
+	err := rec.fileFd.Truncate(int64(size))
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	rec.curSize = int64(size)
+	rec.isFull = rec.curSize >= int64(SEGMENT_MAXSIZE)
 }
 
-func (rec *MsgRecFile) Put(id uint64, body []byte) uint64 {
+/* 以 v1 格式写入, 已有的 v0 记录仍然可以读取 */
+func (rec *MsgRecFile) Put(id uint64, message *Message) uint64 {
+	return rec.PutRaw(NewMsgRec(id, message).Encode())
+}
 
-	msg := new(MsgRec)
-	msg.offset = uint64(id)
-	msg.size = uint64(len(body))
-	msg.body = body
-	msg.CrcSum()
+/* 写入已经编码的记录, 压缩时原样复制记录 */
+func (rec *MsgRecFile) PutRaw(buffer []byte) uint64 {
 
 	_, err := rec.fileFd.Seek(rec.curSize, 0)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	var buffer [24]byte
-	binary.BigEndian.PutUint64(buffer[:], msg.crc64)
-	binary.BigEndian.PutUint64(buffer[8:], msg.size)
-	binary.BigEndian.PutUint64(buffer[16:], msg.offset)
-
-	cnt, err := rec.fileFd.Write(buffer[:])
+	cnt, err := rec.fileFd.Write(buffer)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	if cnt != len(buffer) {
-		log.Fatal("write buffer failed!", buffer)
-	}
-
-	cnt, err = rec.fileFd.Write(msg.body)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-
-	if cnt != len(msg.body) {
-		log.Fatal("write body failed!", body)
+		log.Fatal("write msg record failed!", rec.filename)
 	}
 
 	offset := rec.curSize
-	rec.curSize += int64(msg.size + 24)
-	rec.writeSize += int64(msg.size + 24)
-
-	if rec.writeSize > int64(SEGMENT_SYNCSIZE) {
-		rec.fileFd.Sync()
-		rec.writeSize = 0
-	}
+	rec.curSize += int64(len(buffer))
 
 	if rec.curSize >= int64(SEGMENT_MAXSIZE) {
 		rec.isFull = true
@@ -297,45 +509,68 @@ func (rec *MsgRecFile) Put(id uint64, body []byte) uint64 {
 	return uint64(offset)
 }
 
-func (rec *MsgRecFile) Get(offset uint64) (id uint64, body []byte) {
+/* 按位置读取, 不移动文件偏移, 压缩扫描旧段时可以和其他读取并发 */
+func (rec *MsgRecFile) GetRaw(offset uint64) []byte {
+
+	var buffer [MSGREC_HEADSIZE]byte
 
-	_, err := rec.fileFd.Seek(int64(offset), 0)
+	cnt, err := rec.fileFd.ReadAt(buffer[:], int64(offset))
 	if err != nil {
 		log.Println(err.Error())
-		return INVALID_OFFSET, nil
+		return nil
 	}
 
-	var buffer [24]byte
+	if cnt != len(buffer) {
+		log.Println("read msg reocrd failed!", cnt, buffer)
+		return nil
+	}
+
+	size := binary.BigEndian.Uint64(buffer[8:]) & MSGREC_SIZEMASK
+	if size > uint64(SEGMENT_MAXSIZE) {
+		log.Println("msg record size invalid!", size)
+		return nil
+	}
 
-	cnt, err := rec.fileFd.Read(buffer[:])
+	raw := make([]byte, MSGREC_HEADSIZE+int(size))
+	copy(raw, buffer[:])
+
+	_, err = rec.fileFd.ReadAt(raw[MSGREC_HEADSIZE:], int64(offset)+MSGREC_HEADSIZE)
 	if err != nil {
 		log.Println(err.Error())
-		return INVALID_OFFSET, nil
+		return nil
 	}
 
-	if cnt != len(buffer) {
-		log.Println("read msg reocrd failed!", cnt, buffer)
-		return INVALID_OFFSET, nil
+	_, err = DecodeMsgRec(raw)
+	if err != nil {
+		log.Println("msg record crc check failed!", offset)
+		return nil
 	}
 
-	msgrec := new(MsgRec)
-	msgrec.crc64 = binary.BigEndian.Uint64(buffer[:])
-	msgrec.size = binary.BigEndian.Uint64(buffer[8:])
-	msgrec.offset = binary.BigEndian.Uint64(buffer[16:])
-	msgrec.body = getmsgbody(rec.fileFd, int(msgrec.size))
+	return raw
+}
 
-	if msgrec.body == nil {
-		return INVALID_OFFSET, nil
-	}
+func (rec *MsgRecFile) Get(offset uint64) (id uint64, body []byte) {
 
-	if false == msgrec.CrcCheck() {
-		log.Println("msg record crc check failed!", msgrec)
+	msgrec := rec.GetRec(offset)
+	if msgrec == nil {
 		return INVALID_OFFSET, nil
 	}
 
 	return msgrec.offset, msgrec.body
 }
 
+func (rec *MsgRecFile) GetRec(offset uint64) *MsgRec {
+
+	raw := rec.GetRaw(offset)
+	if raw == nil {
+		return nil
+	}
+
+	msgrec, _ := DecodeMsgRec(raw)
+
+	return msgrec
+}
+
 func (rec *MsgRecFile) Del() {
 	rec.fileFd.Close()
 	err := os.Remove(rec.filename)
@@ -344,31 +579,131 @@ func (rec *MsgRecFile) Del() {
 	}
 }
 
-func checkvalid(seg *Segment) bool {
-	maxidx := seg.idx.Max()
-	for i := uint64(0); i < maxidx; i++ {
-		offset := seg.idx.Get(i)
-		_, msgbody := seg.log.Get(offset)
-		if msgbody == nil {
-			log.Println("gat msg rec failed!", offset)
-			return false
+/* 日志中一条完整记录的偏移和位置 */
+type msgPos struct {
+	id       uint64
+	position uint64
+}
+
+/*
+ * 从头顺序读取日志文件, 返回所有有效记录的位置, 以及第一条损坏或者不完整的记录的位置.
+ * 偏移必须不小于 start 并且递增, 否则也认为日志从这里开始损坏.
+ */
+func (rec *MsgRecFile) scan(start uint64) ([]msgPos, int64) {
+	list := make([]msgPos, 0)
+	rd := bufio.NewReader(io.NewSectionReader(rec.fileFd, 0, rec.curSize))
+
+	var position int64
+
+	for {
+		raw, msgrec, err := readRecord(rd, rec.curSize-position)
+		if err != nil || msgrec.offset < start {
+			break
+		}
+		if len(list) > 0 && msgrec.offset <= list[len(list)-1].id {
+			break
 		}
+
+		list = append(list, msgPos{id: msgrec.offset, position: uint64(position)})
+		position += int64(len(raw))
+	}
+
+	return list, position
+}
+
+/* 从 rd 顺序读取下一条完整的记录, remain 为 rd 剩余的字节数. 没有数据时返回 io.EOF */
+func readRecord(rd *bufio.Reader, remain int64) ([]byte, *MsgRec, error) {
+	var head [MSGREC_HEADSIZE]byte
+
+	_, err := io.ReadFull(rd, head[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := binary.BigEndian.Uint64(head[8:]) & MSGREC_SIZEMASK
+	if size > uint64(remain-MSGREC_HEADSIZE) {
+		return nil, nil, ErrBadRecord
+	}
+
+	raw := make([]byte, MSGREC_HEADSIZE+int(size))
+	copy(raw, head[:])
+	_, err = io.ReadFull(rd, raw[MSGREC_HEADSIZE:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msgrec, err := DecodeMsgRec(raw)
+	if err != nil {
+		return nil, nil, err
 	}
-	return true
+
+	return raw, msgrec, nil
 }
 
-func NewSegment(path string, start uint64) *Segment {
+/* 崩溃恢复的结果 */
+type SegmentRecovery struct {
+	Records   uint64 /* 保留的记录数 */
+	DropBytes int64  /* 日志文件截断的字节数 */
+	DropIndex uint64 /* 丢弃的索引条数 */
+	Upgrade   bool   /* v0 索引按日志重建为 v1 */
+	Rebuild   uint64 /* 根据日志补齐的索引条数 */
+}
 
-	var err error
+/*
+ * 日志和索引的写入不是原子的, 崩溃后尾部可能只写了一半, 或者索引落后于日志.
+ * 保留日志中第一条损坏记录之前的所有记录, 截断之后的内容; 索引和日志逐条比较,
+ * 从第一条不一致的地方截断, 再按日志补齐. v0 索引没有记录的偏移, 清空后全部按日志重建.
+ */
+func (s *Segment) recover() SegmentRecovery {
+	var result SegmentRecovery
+
+	list, valid := s.log.scan(s.start)
+	if valid < s.log.curSize {
+		result.DropBytes = s.log.curSize - valid
+		s.log.Truncate(uint64(valid))
+	}
+
+	if s.idx.version == MSGIDX_V0 {
+		result.Upgrade = true
+		result.DropIndex = s.idx.Max()
+		s.idx.upgrade()
+	}
+
+	var num uint64
+	for num < s.idx.Max() && num < uint64(len(list)) {
+		id, position := s.idx.Get(num)
+		if id != list[num].id || position != list[num].position {
+			break
+		}
+		num++
+	}
+
+	if num < s.idx.Max() || getfilesize(s.idx.fileFd) != s.idx.Size() {
+		result.DropIndex = s.idx.Max() - num
+		s.idx.Truncate(num)
+	}
+
+	for _, v := range list[num:] {
+		s.idx.Put(v.id, v.position)
+		result.Rebuild++
+	}
+
+	result.Records = uint64(len(list))
+
+	return result
+}
+
+func NewSegment(path string, start uint64) *Segment {
 
 	seg := new(Segment)
+	seg.path = path
 	seg.start = start
 	seg.end = start
 
 	logfile := fmt.Sprintf("%s/%020d.log", path, start)
 	idxfile := fmt.Sprintf("%s/%020d.idx", path, start)
 
-	seg.idx = NewMsgIdxFile(idxfile)
+	seg.idx = NewMsgIdxFile(idxfile, start)
 	if seg.idx == nil {
 		log.Fatalln("new idx failed!", idxfile)
 		return nil
@@ -380,15 +715,20 @@ func NewSegment(path string, start uint64) *Segment {
 		return nil
 	}
 
+	seg.recovery = seg.recover()
+	if seg.recovery.Upgrade {
+		log.Println("segment index upgrade to v1!", idxfile)
+	}
+	if seg.recovery.DropBytes > 0 || seg.recovery.DropIndex > 0 || seg.recovery.Rebuild > 0 {
+		log.Printf("segment recover! %s keep %d records, drop %d bytes of log, drop %d index, rebuild %d index.\r\n",
+			logfile, seg.recovery.Records, seg.recovery.DropBytes, seg.recovery.DropIndex, seg.recovery.Rebuild)
+	}
+
 	if seg.idx.Max() > 0 {
-		if false == checkvalid(seg) {
-			log.Println(err.Error())
-			seg.idx.Reset()
-			seg.log.Reset()
-		}
-		seg.end = start + seg.idx.Max() - 1
+		seg.end, _ = seg.idx.Get(seg.idx.Max() - 1)
 		seg.recnum = seg.idx.Max()
 	}
+	seg.timeKnown = seg.recnum == 0
 
 	return seg
 }
@@ -398,22 +738,50 @@ func (s *Segment) IsFull() bool {
 }
 
 func (s *Segment) Write(id uint64, body []byte) error {
+	return s.WriteMessage(id, &Message{Body: body})
+}
+
+func (s *Segment) WriteMessage(id uint64, msg *Message) error {
+	_, err := s.WriteBatch(id, []Message{*msg})
+	return err
+}
+
+/*
+ * 从 id 开始按顺序分配偏移写入多条消息, 记录和索引各编码后一次写入.
+ * 和逐条写入一样, 写入前段已满才不再写入, 返回写入的数量, 一条都没有写入时返回 ErrIsFull.
+ */
+func (s *Segment) WriteBatch(id uint64, msgs []Message) (int, error) {
 
 	if id < s.end {
 		strerr := fmt.Sprintf("input id invalid! %d, %d", id, s.end)
-		return errors.New(strerr)
+		return 0, errors.New(strerr)
 	}
 
 	if s.log.Full() {
-		return ErrIsFull
+		return 0, ErrIsFull
 	}
 
-	offset := s.log.Put(id, body)
-	s.idx.Put(offset)
+	buffer := make([]byte, 0)
+	ids := make([]uint64, 0, len(msgs))
+	positions := make([]uint64, 0, len(msgs))
+
+	size := s.log.curSize
+	for i := 0; i < len(msgs) && size < int64(SEGMENT_MAXSIZE); i++ {
+		s.observe(msgs[i].Timestamp)
+		raw := NewMsgRec(id+uint64(i), &msgs[i]).Encode()
+		ids = append(ids, id+uint64(i))
+		positions = append(positions, uint64(size))
+		buffer = append(buffer, raw...)
+		size += int64(len(raw))
+	}
 
-	s.end = id
+	s.log.PutRaw(buffer)
+	s.idx.PutBatch(ids, positions)
 
-	return nil
+	s.end = ids[len(ids)-1]
+	s.recnum += uint64(len(ids))
+
+	return len(ids), nil
 }
 
 func (s *Segment) Read(id uint64) []byte {
@@ -422,14 +790,128 @@ func (s *Segment) Read(id uint64) []byte {
 		return nil
 	}
 
-	idx := id - s.start
-
-	offset := s.idx.Get(uint64(idx))
-	_, body := s.log.Get(offset)
+	position := s.idx.Find(id)
+	if position == INVALID_OFFSET {
+		return nil
+	}
+	_, body := s.log.Get(position)
 
 	return body
 }
 
+func (s *Segment) ReadRaw(id uint64) []byte {
+
+	if id < s.start || id > s.end {
+		return nil
+	}
+
+	position := s.idx.Find(id)
+	if position == INVALID_OFFSET {
+		return nil
+	}
+
+	return s.log.GetRaw(position)
+}
+
+/* 第一条偏移不小于 id 的记录, 跳过压缩留下的空洞 */
+func (s *Segment) ReadRawFrom(id uint64) (uint64, []byte) {
+	if s.recnum == 0 || id > s.end {
+		return INVALID_OFFSET, nil
+	}
+
+	cur, position := s.idx.Get(s.idx.Search(id))
+	if position == INVALID_OFFSET {
+		return INVALID_OFFSET, nil
+	}
+
+	return cur, s.log.GetRaw(position)
+}
+
+/* 删除 id 之后的记录 */
+func (s *Segment) Truncate(id uint64) {
+	if s.recnum == 0 || id >= s.end {
+		return
+	}
+
+	var num uint64
+	if id >= s.start {
+		num = s.idx.Search(id + 1)
+	}
+
+	var size uint64
+	if num > 0 {
+		_, size = s.idx.Get(num)
+	}
+
+	s.idx.Truncate(num)
+	s.log.Truncate(size)
+
+	s.recnum = num
+	if num == 0 {
+		s.end = s.start
+	} else {
+		s.end, _ = s.idx.Get(num - 1)
+	}
+}
+
+/* 先同步日志再同步索引, 索引不完整时恢复可以按日志重建 */
+func (s *Segment) files() []*os.File {
+	return []*os.File{s.log.fileFd, s.idx.fileFd}
+}
+
+func (s *Segment) Sync() {
+	for _, fd := range s.files() {
+		syncFile(fd)
+	}
+}
+
+/* 索引和日志文件的总大小 */
+func (s *Segment) Size() int64 {
+	return s.log.curSize + int64(s.idx.Size())
+}
+
+/* 最后一次写入的时间, 即段中最新消息的时间 */
+func (s *Segment) observe(timestamp int64) {
+	if timestamp > s.maxTime {
+		s.maxTime = timestamp
+	}
+}
+
+/*
+ * 段中记录的最大创建时间, 毫秒, 只有 v0 记录时为 0. 各副本的记录相同, 不受文件重写和复制影响.
+ * 打开的已有段第一次调用时扫描一遍, 只能在段不再写入或者持有分区锁时调用.
+ */
+func (s *Segment) MaxTime() int64 {
+	if s.timeKnown {
+		return s.maxTime
+	}
+
+	var maxTime int64
+	err := s.Scan(func(rec *MsgRec, raw []byte) bool {
+		if rec.timestamp > maxTime {
+			maxTime = rec.timestamp
+		}
+		return true
+	})
+	if err != nil {
+		log.Println("segment scan timestamp failed!", s.path, s.start, err.Error())
+		return 0
+	}
+
+	s.maxTime = maxTime
+	s.timeKnown = true
+	return s.maxTime
+}
+
+func (s *Segment) ModTime() time.Time {
+	fileinfo, err := s.log.fileFd.Stat()
+	if err != nil {
+		log.Println(err.Error())
+		return time.Now()
+	}
+	return fileinfo.ModTime()
+}
+
 func (s *Segment) Begin() uint64 {
 	return s.start
 }
@@ -438,7 +920,14 @@ func (s *Segment) End() uint64 {
 	return s.end
 }
 
+func (s *Segment) Empty() bool {
+	return s.recnum == 0
+}
+
 func (s *Segment) Find(id uint64) bool {
+	if s.recnum == 0 {
+		return false
+	}
 	if id >= s.start && id <= s.end {
 		return true
 	}
@@ -460,6 +949,102 @@ func (s *Segment) Close() {
 	s.log = nil
 }
 
+/* 压缩时新段先写在这个子目录, 完成后替换原来的段文件 */
+const SEGMENT_CLEANDIR = "cleaned"
+
+/* 依次遍历段中的记录, fn 返回 false 时停止 */
+func (s *Segment) Scan(fn func(rec *MsgRec, raw []byte) bool) error {
+	for i := uint64(0); i < s.idx.Max(); i++ {
+		_, position := s.idx.Get(i)
+		raw := s.log.GetRaw(position)
+		if raw == nil {
+			return ErrBadRecord
+		}
+		rec, err := DecodeMsgRec(raw)
+		if err != nil {
+			return err
+		}
+		if fn(rec, raw) == false {
+			break
+		}
+	}
+	return nil
+}
+
+/*
+ * 只保留 keep 返回 true 的记录, 重写为 v1 索引的新段, 起始偏移不变.
+ * 没有需要删除的记录时返回原来的段. 返回新段和删除的记录数.
+ */
+func (s *Segment) Compact(keep func(rec *MsgRec) bool) (*Segment, int, error) {
+	cleaned, removed, err := s.rewrite(keep)
+	if err != nil || cleaned == s {
+		return s, 0, err
+	}
+	s.replace(cleaned)
+	return cleaned, removed, nil
+}
+
+/* 新段写在 SEGMENT_CLEANDIR 子目录中, 原来的段不变, 只读取已经写满的段时不需要加锁 */
+func (s *Segment) rewrite(keep func(rec *MsgRec) bool) (*Segment, int, error) {
+	removed := 0
+	err := s.Scan(func(rec *MsgRec, raw []byte) bool {
+		if keep(rec) == false {
+			removed++
+		}
+		return true
+	})
+	if err != nil || removed == 0 {
+		return s, 0, err
+	}
+
+	/* 清理上次中断留下的文件 */
+	dir := s.path + "/" + SEGMENT_CLEANDIR
+	os.RemoveAll(dir)
+	err = MkDir(dir)
+	if err != nil {
+		return s, 0, err
+	}
+
+	cleaned := NewSegment(dir, s.start)
+
+	err = s.Scan(func(rec *MsgRec, raw []byte) bool {
+		if keep(rec) {
+			cleaned.observe(rec.timestamp)
+			cleaned.idx.Put(rec.offset, cleaned.log.PutRaw(raw))
+			cleaned.end = rec.offset
+			cleaned.recnum++
+		}
+		return true
+	})
+	if err != nil {
+		cleaned.Delete()
+		return s, 0, err
+	}
+
+	cleaned.Sync()
+
+	return cleaned, removed, nil
+}
+
+/* 用重写后的段文件替换原来的段文件, 关闭原来的段 */
+func (s *Segment) replace(cleaned *Segment) {
+	/* 先替换日志再替换索引, 中途失败时索引和日志不匹配, 重启恢复时按日志重建索引 */
+	err := os.Rename(cleaned.log.filename, s.log.filename)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	err = os.Rename(cleaned.idx.filename, s.idx.filename)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	cleaned.log.filename = s.log.filename
+	cleaned.idx.filename = s.idx.filename
+	cleaned.path = s.path
+
+	s.Close()
+}
+
 type SegList struct {
 	array []*Segment
 }
@@ -470,7 +1055,7 @@ func NewSegList() *SegList {
 	return seglist
 }
 
-func sort(list *SegList) {
+func sortSegList(list *SegList) {
 	copylist := make([]*Segment, 0)
 	num := len(list.array)
 
@@ -494,7 +1079,15 @@ func sort(list *SegList) {
 
 func (list *SegList) Add(seg ...*Segment) {
 	list.array = append(list.array, seg...)
-	sort(list)
+	sortSegList(list)
+}
+
+func (list *SegList) First() *Segment {
+	return list.array[0]
+}
+
+func (list *SegList) Len() int {
+	return len(list.array)
 }
 
 func (list *SegList) Last() *Segment {
@@ -507,6 +1100,12 @@ func (list *SegList) Del() {
 	list.array = list.array[1:]
 }
 
+func (list *SegList) DelLast() {
+	seg := list.Last()
+	seg.Delete()
+	list.array = list.array[:len(list.array)-1]
+}
+
 func (list *SegList) Destory() {
 	for _, v := range list.array {
 		v.Delete()
@@ -2,7 +2,10 @@ package broker
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"log"
+	"os"
 	"testing"
 )
 
@@ -109,3 +112,199 @@ func TestSegment04(t *testing.T) {
 
 	seg.Delete()
 }
+
+func TestSegment05(t *testing.T) {
+	filename := "./00000000000000000001.log"
+
+	/* 旧版本写入的 v0 记录 */
+	old := &MsgRec{offset: 1, size: 5, body: []byte("hello")}
+	old.CrcSum()
+	err := os.WriteFile(filename, old.Encode(), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rec := NewMsgRecFile(filename)
+	if rec == nil {
+		t.Fatal("new msg record file failed!")
+	}
+	defer rec.Del()
+
+	msg := &Message{Key: []byte("user1"), Timestamp: 1234567, Headers: map[string]string{"trace": "t1", "tenant": "a"}, Body: []byte("world")}
+	pos := rec.Put(2, msg)
+
+	id, body := rec.Get(0)
+	if id != 1 || string(body) != "hello" {
+		t.Errorf("read v0 record failed! %d %s", id, body)
+	}
+
+	v1 := rec.GetRec(pos)
+	if v1 == nil || v1.version != MSGREC_V1 {
+		t.Fatalf("read v1 record failed!")
+	}
+	out := v1.Message()
+	if out.Offset != 2 || string(out.Key) != "user1" || out.Timestamp != 1234567 ||
+		len(out.Headers) != 2 || out.Headers["trace"] != "t1" || string(out.Body) != "world" {
+		t.Errorf("v1 record invalid! %v", out)
+	}
+
+	/* 旧版本客户端读到的是去掉 key 和 headers 的 v0 记录 */
+	records := downgradeRecords([][]byte{rec.GetRaw(pos)}, MSGREC_V0)
+	down, err := DecodeMsgRec(records[0])
+	if err != nil || down.version != MSGREC_V0 || down.offset != 2 || string(down.body) != "world" {
+		t.Errorf("downgrade record invalid! %v", err)
+	}
+}
+
+func TestSegment06(t *testing.T) {
+	path := "./seg06"
+	os.RemoveAll(path)
+	if err := MkDir(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	/* 旧版本写入的 v0 索引, 每条只有记录的位置 */
+	var logbuf, idxbuf []byte
+	for i := uint64(1); i <= 3; i++ {
+		rec := &MsgRec{offset: i, size: 5, body: []byte(fmt.Sprintf("body%d", i))}
+		rec.CrcSum()
+		var pos [8]byte
+		binary.BigEndian.PutUint64(pos[:], uint64(len(logbuf)))
+		idxbuf = append(idxbuf, pos[:]...)
+		logbuf = append(logbuf, rec.Encode()...)
+	}
+	os.WriteFile(path+"/00000000000000000001.log", logbuf, 0644)
+	os.WriteFile(path+"/00000000000000000001.idx", idxbuf, 0644)
+
+	/* 打开时按日志重建为 v1 索引 */
+	seg := NewSegment(path, 1)
+	if seg.recovery.Upgrade == false || seg.idx.version != MSGIDX_V1 || seg.End() != 3 || string(seg.Read(2)) != "body2" {
+		t.Fatalf("upgrade v0 index failed! %d %d", seg.idx.version, seg.End())
+	}
+
+	seg.Write(4, []byte("body4"))
+	if string(seg.Read(4)) != "body4" {
+		t.Errorf("append upgraded index failed!")
+	}
+
+	seg, removed, err := seg.Compact(func(rec *MsgRec) bool { return rec.offset%2 == 1 })
+	if err != nil || removed != 2 || seg.idx.version != MSGIDX_V1 {
+		t.Fatalf("compact segment failed! %d %v", removed, err)
+	}
+	if seg.ReadRaw(2) != nil || string(seg.Read(3)) != "body3" {
+		t.Errorf("read compacted segment failed!")
+	}
+	if id, _ := seg.ReadRawFrom(2); id != 3 {
+		t.Errorf("read from gap failed! %d", id)
+	}
+	seg.Close()
+
+	seg = NewSegment(path, 1)
+	if seg.End() != 3 || seg.idx.Max() != 2 || string(seg.Read(1)) != "body1" {
+		t.Errorf("reopen compacted segment failed! %d %d", seg.End(), seg.idx.Max())
+	}
+	seg.Close()
+}
+
+func TestSegment07(t *testing.T) {
+	path := "./seg07"
+	os.RemoveAll(path)
+	if err := MkDir(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	logfile := path + "/00000000000000000001.log"
+	idxfile := path + "/00000000000000000001.idx"
+
+	seg := NewSegment(path, 1)
+	for i := uint64(1); i <= 10; i++ {
+		seg.Write(i, []byte(fmt.Sprintf("body%d", i)))
+	}
+	_, pos7 := seg.idx.Get(6)
+	seg.Close()
+
+	/* 日志尾部只写了一半的记录 */
+	torn := NewMsgRec(11, &Message{Body: []byte("body11")}).Encode()
+	fd, _ := os.OpenFile(logfile, os.O_WRONLY|os.O_APPEND, 0)
+	fd.Write(torn[:len(torn)/2])
+	fd.Close()
+
+	seg = NewSegment(path, 1)
+	if seg.recovery.Records != 10 || seg.recovery.DropBytes != int64(len(torn)/2) || seg.End() != 10 {
+		t.Errorf("recover torn tail failed! %+v", seg.recovery)
+	}
+	seg.Close()
+
+	/* 索引落后于日志 */
+	os.Truncate(idxfile, MSGIDX_HEADSIZE+5*16+3)
+
+	seg = NewSegment(path, 1)
+	if seg.recovery.Rebuild != 5 || seg.End() != 10 || string(seg.Read(8)) != "body8" {
+		t.Errorf("rebuild index failed! %+v", seg.recovery)
+	}
+	seg.Close()
+
+	/* 中间的记录损坏, 保留之前的记录 */
+	fd, _ = os.OpenFile(logfile, os.O_RDWR, 0)
+	fd.WriteAt([]byte("X"), int64(pos7)+MSGREC_HEADSIZE+20)
+	fd.Close()
+
+	seg = NewSegment(path, 1)
+	if seg.recovery.Records != 6 || seg.recovery.DropIndex != 4 || seg.End() != 6 {
+		t.Errorf("recover corrupt record failed! %+v", seg.recovery)
+	}
+	if string(seg.Read(6)) != "body6" || seg.Read(7) != nil {
+		t.Errorf("read recovered segment failed!")
+	}
+
+	seg.Write(7, []byte("body7"))
+	if string(seg.Read(7)) != "body7" {
+		t.Errorf("write after recover failed!")
+	}
+	seg.Close()
+}
+
+func TestSegment08(t *testing.T) {
+	path := "./seg08"
+	os.RemoveAll(path)
+	if err := MkDir(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(path)
+
+	/* 旧版本的第一个段: 文件名的起始偏移为 0, 第一条记录的偏移为 1 */
+	var logbuf, idxbuf []byte
+	for i := uint64(1); i <= 3; i++ {
+		rec := &MsgRec{offset: i, size: 5, body: []byte(fmt.Sprintf("body%d", i))}
+		rec.CrcSum()
+		var pos [8]byte
+		binary.BigEndian.PutUint64(pos[:], uint64(len(logbuf)))
+		idxbuf = append(idxbuf, pos[:]...)
+		logbuf = append(logbuf, rec.Encode()...)
+	}
+	os.WriteFile(path+"/00000000000000000000.log", logbuf, 0644)
+	os.WriteFile(path+"/00000000000000000000.idx", idxbuf, 0644)
+
+	seg := NewSegment(path, 0)
+	if seg.recovery.Upgrade == false || seg.recovery.Records != 3 || seg.End() != 3 {
+		t.Fatalf("open baseline segment failed! %+v %d", seg.recovery, seg.End())
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if string(seg.Read(i)) != fmt.Sprintf("body%d", i) {
+			t.Errorf("read baseline segment offset %d failed!", i)
+		}
+	}
+	if seg.Read(0) != nil {
+		t.Errorf("offset 0 should not exist!")
+	}
+	seg.Write(4, []byte("body4"))
+	seg.Close()
+
+	seg = NewSegment(path, 0)
+	if seg.recovery.Upgrade || seg.idx.version != MSGIDX_V1 || seg.End() != 4 || string(seg.Read(4)) != "body4" {
+		t.Errorf("reopen upgraded segment failed! %+v %d", seg.recovery, seg.End())
+	}
+	seg.Close()
+}
@@ -0,0 +1,396 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	FETCH_MAXCOUNT = 1000
+	FETCH_MAXBYTES = 1024 * 1024
+	ACKS_TIMEOUT   = 5 * time.Second
+)
+
+var (
+	ErrNoEtcd = errors.New("etcd is not connected!")
+)
+
+type BrokerServer struct {
+	sync.Mutex
+
+	Addr     string
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wait     sync.WaitGroup
+}
+
+func NewBrokerServer(addr string) (*BrokerServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(BrokerServer)
+	s.Addr = listener.Addr().String()
+	s.listener = listener
+	s.conns = make(map[net.Conn]struct{}, 0)
+
+	return s, nil
+}
+
+func (s *BrokerServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.Lock()
+		s.conns[conn] = struct{}{}
+		s.Unlock()
+
+		s.wait.Add(1)
+		go s.process(conn)
+	}
+}
+
+func (s *BrokerServer) Stop() {
+	s.listener.Close()
+
+	s.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.Unlock()
+
+	s.wait.Wait()
+}
+
+/*
+ * 请求按序处理, 应答由单独的协程批量写回, 客户端可在一个连接上流水线发送请求.
+ * acks=all 的生产请求在单独的协程中等待同步副本, 不阻塞后面的请求, 客户端按 CorrelationID 匹配应答.
+ */
+func (s *BrokerServer) process(conn net.Conn) {
+	var pending sync.WaitGroup
+
+	rspChan := make(chan []byte, 100)
+	exit := make(chan struct{})
+
+	go func() {
+		defer close(exit)
+
+		wr := bufio.NewWriter(conn)
+		for frame := range rspChan {
+			err := writeFrame(wr, frame)
+			if err == nil && len(rspChan) == 0 {
+				err = wr.Flush()
+			}
+			if err != nil {
+				log.Println("write response failed!", conn.RemoteAddr(), err.Error())
+				conn.Close()
+				for range rspChan {
+				}
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		pending.Wait()
+		close(rspChan)
+		<-exit
+
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+
+		conn.Close()
+		s.wait.Done()
+	}()
+
+	rd := bufio.NewReader(conn)
+
+	for {
+		frame, err := readFrame(rd)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("read request failed!", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+
+		var hdr ReqHeader
+		dec := &decoder{buf: frame}
+		hdr.decode(dec)
+		dec.version = hdr.ApiVersion
+		if dec.err != nil {
+			log.Println("request header invalid!", conn.RemoteAddr())
+			return
+		}
+
+		rsp, wait := s.handle(&hdr, dec)
+		if rsp != nil {
+			rspChan <- rsp
+		}
+		if wait != nil {
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				rspChan <- wait()
+			}()
+		}
+	}
+}
+
+/* 需要等待的请求返回 wait, 等待结束后由 wait 生成应答 */
+func (s *BrokerServer) handle(hdr *ReqHeader, dec *decoder) ([]byte, func() []byte) {
+	var rsp message
+	var wait func() error
+	var err error
+
+	version, b := apiVersions[hdr.ApiKey]
+	if b == false {
+		err = ErrUnsupportedApi
+	} else if hdr.ApiVersion > version {
+		err = ErrUnsupportedVersion
+	} else {
+		rsp, wait, err = s.dispatch(hdr, dec)
+		if rsp == nil && err == nil {
+			return nil, nil
+		}
+	}
+
+	if wait != nil && err == nil {
+		return nil, func() []byte {
+			return response(hdr, rsp, wait())
+		}
+	}
+
+	return response(hdr, rsp, err), nil
+}
+
+func response(hdr *ReqHeader, rsp message, err error) []byte {
+	enc := &encoder{version: hdr.ApiVersion}
+	rsphdr := RspHeader{CorrelationID: hdr.CorrelationID, ErrCode: errToCode(err)}
+	rsphdr.encode(enc)
+
+	if err != nil {
+		enc.PutString(err.Error())
+	} else {
+		rsp.encode(enc)
+	}
+
+	return enc.buf
+}
+
+func (s *BrokerServer) dispatch(hdr *ReqHeader, dec *decoder) (message, func() error, error) {
+	switch hdr.ApiKey {
+	case API_PRODUCE:
+		{
+			var req ProduceReq
+			req.decode(dec)
+			if dec.err != nil {
+				return nil, nil, dec.err
+			}
+			return handleProduce(&req)
+		}
+	case API_FETCH:
+		{
+			var req FetchReq
+			req.decode(dec)
+			if dec.err != nil {
+				return nil, nil, dec.err
+			}
+			rsp, err := handleFetch(&req)
+			return rsp, nil, err
+		}
+	case API_METADATA:
+		{
+			var req MetadataReq
+			req.decode(dec)
+			if dec.err != nil {
+				return nil, nil, dec.err
+			}
+			rsp, err := handleMetadata(&req)
+			return rsp, nil, err
+		}
+	case API_OFFSET_COMMIT:
+		{
+			var req OffsetCommitReq
+			req.decode(dec)
+			if dec.err != nil {
+				return nil, nil, dec.err
+			}
+			rsp, err := handleOffsetCommit(&req)
+			return rsp, nil, err
+		}
+	}
+
+	return nil, nil, ErrUnsupportedApi
+}
+
+/* 毫秒超时转换为等待时长, 0 使用默认值 */
+func acksTimeout(timeout uint32) time.Duration {
+	if timeout == 0 {
+		return ACKS_TIMEOUT
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+/* acks=all 时返回等待同步副本的 wait, 由调用者决定在哪里等待 */
+func handleProduce(req *ProduceReq) (message, func() error, error) {
+	if req.Acks.Valid() == false {
+		return nil, nil, ErrAcksInvalid
+	}
+
+	rsp := &ProduceRsp{Offsets: make([]uint64, 0, len(req.Messages))}
+
+	var err error
+	if len(req.Messages) > 0 {
+		var first, last uint64
+		first, last, err = gPartitionMng.PutMessages(req.PartitionID, req.Messages)
+		for offset := first; err == nil && offset <= last; offset++ {
+			rsp.Offsets = append(rsp.Offsets, offset)
+		}
+	}
+
+	if req.Acks == ACKS_NONE {
+		if err != nil {
+			log.Println("produce without ack failed!", req.PartitionID, err.Error())
+		}
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if req.Acks != ACKS_ALL || len(rsp.Offsets) == 0 {
+		return rsp, nil, nil
+	}
+
+	last := rsp.Offsets[len(rsp.Offsets)-1]
+	wait := func() error {
+		return gPartitionMng.WaitAcks(req.PartitionID, last, req.Acks, acksTimeout(req.Timeout))
+	}
+
+	return rsp, wait, nil
+}
+
+func handleFetch(req *FetchReq) (message, error) {
+	maxcount := int(req.MaxCount)
+	if maxcount == 0 || maxcount > FETCH_MAXCOUNT {
+		maxcount = FETCH_MAXCOUNT
+	}
+
+	maxbytes := int(req.MaxBytes)
+	if maxbytes == 0 || maxbytes > FETCH_MAXBYTES {
+		maxbytes = FETCH_MAXBYTES
+	}
+
+	if req.ReplicaID != "" {
+		records, hw, err := gPartitionMng.ReplicaFetch(req.PartitionID, req.ReplicaID, req.Offset, maxcount, maxbytes)
+		if err != nil {
+			return nil, err
+		}
+		start, err := gPartitionMng.StartOffset(req.PartitionID)
+		if err != nil {
+			return nil, err
+		}
+		return &FetchRsp{Records: records, HighWater: hw, LogStart: start}, nil
+	}
+
+	records, hw, start, err := gPartitionMng.Fetch(req.PartitionID, req.Offset, maxcount, maxbytes)
+	if err == ErrOffsetOutOfRange && req.version >= 4 {
+		return &FetchRsp{Records: make([][]byte, 0), HighWater: hw, LogStart: start}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &FetchRsp{Records: downgradeRecords(records, req.RecordVersion), HighWater: hw, LogStart: start}, nil
+}
+
+/* 旧版本客户端不认识新格式的记录, 去掉 key、创建时间和 headers 后按 v0 格式返回 */
+func downgradeRecords(records [][]byte, version uint8) [][]byte {
+	for i, raw := range records {
+		if len(raw) < MSGREC_HEADSIZE || raw[8] <= version {
+			continue
+		}
+		msgrec, err := DecodeMsgRec(raw)
+		if err != nil {
+			continue
+		}
+		rec := &MsgRec{offset: msgrec.offset, size: uint64(len(msgrec.body)), body: msgrec.body}
+		rec.CrcSum()
+		records[i] = rec.Encode()
+	}
+	return records
+}
+
+func handleMetadata(req *MetadataReq) (message, error) {
+	if gEtcd == nil {
+		return nil, ErrNoEtcd
+	}
+
+	var err error
+
+	rsp := new(MetadataRsp)
+	rsp.Brokers, err = BrokerServerGet(gEtcd)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Topics, err = BrokerTopicGet(gEtcd)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Partitions, err = BrokerPartitionGet(gEtcd)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Topics) == 0 {
+		return rsp, nil
+	}
+
+	topics := make([]DataTopic, 0)
+	partitions := make([]DataPartition, 0)
+
+	for _, topic := range rsp.Topics {
+		for _, name := range req.Topics {
+			if topic.Topic == name {
+				topics = append(topics, topic)
+			}
+		}
+	}
+
+	for _, partition := range rsp.Partitions {
+		for _, topic := range topics {
+			if stringsHas(topic.Partitions, partition.PartitionID) {
+				partitions = append(partitions, partition)
+			}
+		}
+	}
+
+	rsp.Topics = topics
+	rsp.Partitions = partitions
+
+	return rsp, nil
+}
+
+func handleOffsetCommit(req *OffsetCommitReq) (message, error) {
+	if gEtcd == nil {
+		return nil, ErrNoEtcd
+	}
+
+	err := BrokerOffsetCommit(gEtcd, req.ConsumerID, req.Topic, req.PartitionID, req.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OffsetCommitRsp{}, nil
+}
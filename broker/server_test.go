@@ -0,0 +1,406 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer01(t *testing.T) {
+	part := NewPartition("0x135792468", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewBrokerServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := NewBrokerClient(server.Addr)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer client.Close()
+
+	for i := 0; i < 100; i++ {
+		offset, err := client.Produce(part.ID, []byte(fmt.Sprintf("helloworld%d", i)))
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		if offset != uint64(i+1) {
+			t.Errorf("produce offset %d invalid!", offset)
+			return
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		body, err := client.Fetch(part.ID, uint64(i+1))
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		if string(body) != fmt.Sprintf("helloworld%d", i) {
+			t.Errorf("fetch offset %d invalid! %s", i+1, body)
+			return
+		}
+	}
+
+	_, err = client.Fetch(part.ID, 101)
+	if err != ErrNoMessage {
+		t.Errorf("fetch offset 101 should be none! %v", err)
+	}
+
+	_, err = client.Produce("0xnotexist", []byte("helloworld"))
+	if err != ErrUnknownPartition {
+		t.Errorf("produce to unknown partition should fail! %v", err)
+	}
+
+	part.Reset()
+}
+
+func TestServer02(t *testing.T) {
+	part := NewPartition("0x246813579", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewBrokerServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := NewBrokerClient(server.Addr)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer client.Close()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			messages := make([][]byte, 0)
+			for j := 0; j < 100; j++ {
+				messages = append(messages, []byte(fmt.Sprintf("helloworld%d_%d", i, j)))
+			}
+			offsets, err := client.ProduceBatch(part.ID, messages)
+			if err != nil || len(offsets) != len(messages) {
+				t.Errorf("produce batch failed! %v", err)
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	messages, err := client.FetchBatch(part.ID, 1, 2000, 0)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if len(messages) != 1000 {
+		t.Errorf("fetch batch count %d invalid!", len(messages))
+		return
+	}
+	for i, v := range messages {
+		if v.Offset != uint64(i+1) {
+			t.Errorf("fetch batch offset %d invalid!", v.Offset)
+			return
+		}
+	}
+
+	messages, err = client.FetchBatch(part.ID, 1, 2000, 50)
+	if err != nil || len(messages) != 1 {
+		t.Errorf("fetch batch max bytes invalid! %v", err)
+	}
+
+	var rsp ProduceRsp
+	client.ClientID = "test"
+	err = client.call(API_KEY(100), &ProduceReq{PartitionID: part.ID}, &rsp)
+	if err != ErrUnsupportedApi {
+		t.Errorf("unknown api should fail! %v", err)
+	}
+
+	part.Reset()
+}
+
+func TestServer03(t *testing.T) {
+	part := NewPartition("0x357913579", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+	part.SetSyncReplicas(map[string]uint64{"broker1": 0})
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewBrokerServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := NewBrokerClient(server.Addr)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer client.Close()
+
+	_, err = client.ProduceAcks(part.ID, [][]byte{[]byte("helloworld1")}, ACKS_NONE, 0)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	offsets, err := client.ProduceAcks(part.ID, [][]byte{[]byte("helloworld2")}, ACKS_PRIMARY, 0)
+	if err != nil || offsets[0] != 2 {
+		t.Errorf("produce with acks 1 failed! %v %v", offsets, err)
+		return
+	}
+
+	_, err = client.ProduceAcks(part.ID, [][]byte{[]byte("helloworld3")}, ACKS_ALL, 100*time.Millisecond)
+	if err != ErrAckTimeout {
+		t.Errorf("produce with acks all should timeout! %v", err)
+		return
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		part.ReplicaOffset("broker1", 4)
+	}()
+
+	offsets, err = client.ProduceAcks(part.ID, [][]byte{[]byte("helloworld4")}, ACKS_ALL, time.Second)
+	if err != nil || offsets[0] != 4 {
+		t.Errorf("produce with acks all failed! %v %v", offsets, err)
+	}
+
+	part.Reset()
+}
+
+func TestServer04(t *testing.T) {
+	part := NewPartition("0x975318642", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+	defer part.Reset()
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewBrokerServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := NewBrokerClient(server.Addr)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer client.Close()
+
+	messages := []Message{
+		{Key: []byte("user1"), Headers: map[string]string{"trace": "t1"}, Body: []byte("hello")},
+		{Key: []byte("user2"), Timestamp: 1234567, Body: []byte("world")},
+	}
+	_, err = client.ProduceMessages(part.ID, messages, ACKS_PRIMARY, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	list, err := client.FetchBatch(part.ID, 1, 10, 0)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("fetch messages failed! %v", err)
+	}
+	if string(list[0].Key) != "user1" || list[0].Headers["trace"] != "t1" || list[0].Timestamp == 0 {
+		t.Errorf("message key and headers invalid! %v", list[0])
+	}
+	if string(list[1].Key) != "user2" || list[1].Timestamp != 1234567 || string(list[1].Body) != "world" {
+		t.Errorf("message timestamp invalid! %v", list[1])
+	}
+}
+
+func TestServer05(t *testing.T) {
+	part := NewPartition("0x864297531", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+	defer part.Reset()
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewBrokerServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := NewBrokerClient(server.Addr)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer client.Close()
+
+	part.ResetStart(50)
+
+	offset, err := client.Produce(part.ID, []byte("helloworld"))
+	if err != nil || offset != 50 {
+		t.Fatalf("produce after reset start invalid! %d %v", offset, err)
+	}
+
+	/* 消费位置已经被清理时返回日志起始偏移, 消费者从这里继续 */
+	_, hw, start, err := client.FetchRange(part.ID, 1, 10, 0)
+	if err != ErrOffsetOutOfRange || start != 50 || hw != 50 {
+		t.Fatalf("fetch out of range invalid! %d %d %v", hw, start, err)
+	}
+
+	list, _, _, err := client.FetchRange(part.ID, start, 10, 0)
+	if err != nil || len(list) != 1 || string(list[0].Body) != "helloworld" {
+		t.Fatalf("fetch from log start failed! %v", err)
+	}
+}
+
+func TestServer06(t *testing.T) {
+	req := OffsetCommitReq{ConsumerID: "c1", Topic: "orders", Offset: 10, PartitionID: "p1"}
+
+	enc := &encoder{version: 1}
+	req.encode(enc)
+	var v1 OffsetCommitReq
+	v1.decode(&decoder{buf: enc.buf, version: 1})
+	if v1 != req {
+		t.Errorf("decode offset commit v1 invalid! %+v", v1)
+	}
+
+	/* v0 请求没有分区, 按 topic 提交 */
+	enc = &encoder{version: 0}
+	req.encode(enc)
+	var v0 OffsetCommitReq
+	v0.decode(&decoder{buf: enc.buf, version: 0})
+	if v0.PartitionID != "" || v0.Offset != 10 {
+		t.Errorf("decode offset commit v0 invalid! %+v", v0)
+	}
+
+	consumer := &DataConsumer{ConsumerID: "c1", Subs: []DataSubscribe{{Topic: "orders", Offset: 5}}}
+	consumer.Update("orders", "p1", 10)
+	consumer.Update("orders", "p2", 20)
+	consumer.Update("orders", "p1", 11)
+
+	if sub := consumer.Find("orders", "p1"); sub == nil || sub.Offset != 11 {
+		t.Errorf("find partition p1 offset invalid! %v", sub)
+	}
+	if sub := consumer.Find("orders", "p2"); sub == nil || sub.Offset != 20 {
+		t.Errorf("find partition p2 offset invalid! %v", sub)
+	}
+	/* 还没有提交过的分区使用旧版本按 topic 提交的偏移 */
+	if sub := consumer.Find("orders", "p3"); sub == nil || sub.Offset != 5 {
+		t.Errorf("find legacy topic offset invalid! %v", sub)
+	}
+	if len(consumer.Subs) != 3 {
+		t.Errorf("consumer subscribes invalid! %v", consumer.Subs)
+	}
+}
+
+func TestServer07(t *testing.T) {
+	part := NewPartition("0x246813579", PART_S_PRIMARY)
+	if part == nil {
+		t.Errorf("new partition failed!")
+		return
+	}
+	part.Reset()
+	part.SetSyncReplicas(map[string]uint64{"broker1": 0})
+
+	gPartitionMng.Lock()
+	gPartitionMng.PartitionSeg[part.ID] = part
+	gPartitionMng.Unlock()
+
+	server, err := NewBrokerServer("127.0.0.1:0")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	go server.Serve()
+	defer server.Stop()
+
+	client, err := NewBrokerClient(server.Addr)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer client.Close()
+
+	_, err = client.ProduceAcks(part.ID, [][]byte{[]byte("helloworld1")}, ACKS(5), 0)
+	if err != ErrAcksInvalid {
+		t.Errorf("produce with invalid acks should fail! %v", err)
+		return
+	}
+
+	/* 等待同步副本期间, 同一连接上后面的请求照常应答 */
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ProduceAcks(part.ID, [][]byte{[]byte("helloworld2")}, ACKS_ALL, time.Second)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	begin := time.Now()
+	/* 高水位还没有推进, 消息对消费者不可见 */
+	messages, _, _, err := client.FetchRange(part.ID, 1, 10, 0)
+	if err != nil || len(messages) != 0 {
+		t.Errorf("fetch failed! %v %v", messages, err)
+		return
+	}
+	if time.Since(begin) > 500*time.Millisecond {
+		t.Errorf("fetch is blocked by produce acks wait!")
+	}
+
+	part.ReplicaOffset("broker1", 2)
+
+	err = <-done
+	if err != nil {
+		t.Errorf("produce with acks all failed! %v", err)
+	}
+
+	part.Reset()
+}
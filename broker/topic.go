@@ -1,6 +1,136 @@
 package broker
 
-type Topic struct {
-	Name        string `json:"name"`
-	PartitionID string `json:"partitionid"`
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/*
+ * topic 由多个分区组成, 分区记录的 Topic 和 ReplicasNum 来自 topic 的配置,
+ * 控制器按 ReplicasNum 维护副本. 创建时先写 topic 记录占用名字, 再写分区记录;
+ * 删除时先删 topic 记录, 再删分区记录, broker 收到分区删除后删除本地数据.
+ */
+
+/* 为 topic 放置分区, 各分区的主副本依次落在不同的 broker 上 */
+func newTopicPlace(name string, partitions int, replicas int, load *brokerLoad) (DataTopic, []DataPartition) {
+	topic := DataTopic{Topic: name, Replicas: replicas}
+	list := make([]DataPartition, 0, partitions)
+
+	for i := 0; i < partitions; i++ {
+		partition := newPartitionPlace(replicas, load)
+		partition.Topic = name
+		partition.ReplicasNum = replicas
+
+		topic.Partitions = append(topic.Partitions, partition.PartitionID)
+		list = append(list, *partition)
+	}
+
+	return topic, list
+}
+
+func BrokerTopicAlloc(etcdconn *EtcdConn, name string, partitions int, replicas int, policy TopicPolicy) (*DataTopic, error) {
+	if name == "" || strings.Contains(name, "/") || partitions <= 0 || replicas <= 0 {
+		return nil, errors.New("topic param is invalid!")
+	}
+
+	decommission, err := BrokerDecommissionGet(etcdconn)
+	if err != nil {
+		return nil, err
+	}
+	brokers, err := BrokerServerGet(etcdconn)
+	if err != nil {
+		return nil, err
+	}
+	partitionlist, err := BrokerPartitionGet(etcdconn)
+	if err != nil {
+		return nil, err
+	}
+
+	available := make([]DataBroker, 0)
+	for _, v := range brokers {
+		if decommission[v.Broker] == false {
+			available = append(available, v)
+		}
+	}
+	if len(available) < replicas {
+		return nil, fmt.Errorf("replicas %d is more than brokers %d!", replicas, len(available))
+	}
+
+	load := newBrokerLoad(available, partitionlist)
+	topic, list := newTopicPlace(name, partitions, replicas, load)
+	topic.TopicPolicy = policy
+
+	err = BrokerTopicCreate(etcdconn, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range list {
+		err = BrokerPartitionPut(etcdconn, v)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("partition create!", v)
+	}
+
+	return &topic, nil
+}
+
+/* 修改清理策略, 各 broker 的清理协程下一次运行时生效 */
+func BrokerTopicConfig(etcdconn *EtcdConn, name string, policy TopicPolicy) (*DataTopic, error) {
+	topic, err := BrokerTopicFind(etcdconn, name)
+	if err != nil {
+		if err == ErrIsNone {
+			return nil, ErrTopicNotExist
+		}
+		return nil, err
+	}
+
+	topic.TopicPolicy = policy
+
+	err = BrokerTopicPut(etcdconn, *topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return topic, nil
+}
+
+func BrokerTopicFree(etcdconn *EtcdConn, name string) error {
+	topic, err := BrokerTopicFind(etcdconn, name)
+	if err != nil {
+		if err == ErrIsNone {
+			return ErrTopicNotExist
+		}
+		return err
+	}
+
+	err = BrokerTopicDelete(etcdconn, name)
+	if err != nil {
+		return err
+	}
+
+	reassigns, err := BrokerReassignGet(etcdconn)
+	if err != nil {
+		return err
+	}
+
+	for _, partitionId := range topic.Partitions {
+		if _, b := reassigns[partitionId]; b {
+			err = BrokerReassignDelete(etcdconn, partitionId)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = BrokerPartitionDelete(etcdconn, partitionId)
+		if err != nil {
+			return err
+		}
+		log.Println("partition delete!", partitionId)
+	}
+
+	return nil
 }
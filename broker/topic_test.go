@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestTopic01(t *testing.T) {
+	brokers := []DataBroker{{Broker: "broker1"}, {Broker: "broker2"}, {Broker: "broker3"}}
+	load := newBrokerLoad(brokers, nil)
+
+	topic, partitions := newTopicPlace("orders", 6, 2, load)
+	if len(topic.Partitions) != 6 || len(partitions) != 6 {
+		t.Fatalf("topic partitions invalid! %v", topic)
+	}
+
+	primary := make(map[string]int, 0)
+	for i, v := range partitions {
+		if v.PartitionID != topic.Partitions[i] || v.Topic != "orders" || v.ReplicasNum != 2 {
+			t.Errorf("partition invalid! %v", v)
+		}
+		if len(v.Replicas) != 2 || v.Replicas[0].Broker == v.Replicas[1].Broker {
+			t.Errorf("partition replicas invalid! %v", v.Replicas)
+		}
+		primary[v.Replicas[0].Broker]++
+	}
+
+	for _, v := range brokers {
+		if load.count[v.Broker] != 4 || primary[v.Broker] != 2 {
+			t.Errorf("broker %s load %d primary %d invalid!", v.Broker, load.count[v.Broker], primary[v.Broker])
+		}
+	}
+}
+
+func TestTopic02(t *testing.T) {
+	rsp := &MetadataRsp{Topics: []DataTopic{{Topic: "orders", Partitions: []string{"p1", "p2"}}}}
+
+	for _, version := range []uint16{0, 1} {
+		e := &encoder{version: version}
+		rsp.encode(e)
+
+		var out MetadataRsp
+		d := &decoder{buf: e.buf, version: version}
+		out.decode(d)
+		if d.err != nil || len(out.Topics) != 1 {
+			t.Fatalf("metadata v%d decode failed! %v", version, d.err)
+		}
+
+		want := 2
+		if version == 0 {
+			want = 1
+		}
+		if len(out.Topics[0].Partitions) != want || out.Topics[0].Partitions[0] != "p1" {
+			t.Errorf("metadata v%d topic invalid! %v", version, out.Topics[0])
+		}
+	}
+}
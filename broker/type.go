@@ -29,6 +29,8 @@ type DataPartition struct {
 	Status      PART_S         `json:"status"`
 	Topic       string         `json:"topic"`
 	Replicas    []PartReplicas `json:"replicas"`
+	ISR         []string       `json:"isr,omitempty"`         /* 同步副本集合, 包含主副本 */
+	ReplicasNum int            `json:"replicasnum,omitempty"` /* 副本数量, 为 0 时使用 DataCommon 的配置 */
 }
 
 var KEY_BROKER = "/" + CLUSTER_NAME + "/broker/"
@@ -36,18 +38,36 @@ var KEY_BROKER = "/" + CLUSTER_NAME + "/broker/"
 type DataBroker struct {
 	Broker string `json:"broker"`
 	Addr   string `json:"endpoint"`
+	Grpc   string `json:"grpc,omitempty"`
+	Http   string `json:"http,omitempty"`
+	Rack   string `json:"rack,omitempty"`
 }
 
 var KEY_TOPIC = "/" + CLUSTER_NAME + "/topic/"
 
+/* topic 的日志清理策略, 由各 broker 的清理协程执行, 保留策略为 0 表示不限制 */
+type TopicPolicy struct {
+	RetentionMs    int64 `json:"retentionms,omitempty"`    /* 消息保留时间, 毫秒 */
+	RetentionBytes int64 `json:"retentionbytes,omitempty"` /* 每个分区保留的最大字节数 */
+	Compact        bool  `json:"compact,omitempty"`        /* 按 key 压缩, 只保留最新的消息 */
+	TombstoneMs    int64 `json:"tombstonems,omitempty"`    /* 墓碑保留时间, 毫秒, 0 使用默认值 */
+
+	Fsync      string `json:"fsync,omitempty"`      /* 落盘策略: always, interval, bytes, none, 空使用默认值 */
+	FsyncMs    int64  `json:"fsyncms,omitempty"`    /* interval 策略的同步间隔, 毫秒 */
+	FsyncBytes int64  `json:"fsyncbytes,omitempty"` /* bytes 策略的同步阈值 */
+}
+
 type DataTopic struct {
-	Topic       string `json:"topic"`
-	PartitionID string `json:"partitionid"`
+	Topic      string   `json:"topic"`
+	Partitions []string `json:"partitions"`
+	Replicas   int      `json:"replicas"`
+	TopicPolicy
 }
 
 type DataSubscribe struct {
-	Topic  string `json:"topic"`
-	Offset uint64 `json:"offset"`
+	Topic       string `json:"topic"`
+	PartitionID string `json:"partitionid,omitempty"`
+	Offset      uint64 `json:"offset"`
 }
 
 var KEY_CONSUMER = "/" + CLUSTER_NAME + "/consumer/"
@@ -57,10 +77,47 @@ type DataConsumer struct {
 	Subs       []DataSubscribe `json:"subs"`
 }
 
+var KEY_GROUP = "/" + CLUSTER_NAME + "/group/"
+
+/* 消费组的分区偏移和分区当前的消费者, 按 <group>/<partition> 存放 */
+var KEY_GROUPOFFSET = "/" + CLUSTER_NAME + "/groupoffset/"
+var KEY_GROUPOWNER = "/" + CLUSTER_NAME + "/groupowner/"
+
+var KEY_CONTROLLER = "/" + CLUSTER_NAME + "/controller"
+
+var KEY_REASSIGN = "/" + CLUSTER_NAME + "/reassign/"
+
+/* 正在下线的 broker, 控制器不再往上面放置副本, broker 重新注册时删除 */
+var KEY_DECOMMISSION = "/" + CLUSTER_NAME + "/decommission/"
+
+/* 分区副本迁移请求, 由控制器执行, 完成后删除 */
+type DataReassign struct {
+	PartitionID string   `json:"partitionid"`
+	Replicas    []string `json:"replicas"`
+}
+
+type DataGroupMember struct {
+	ConsumerID string   `json:"consumerid"`
+	Topics     []string `json:"topics"`
+	Strategy   string   `json:"strategy"`
+}
+
 const (
 	INVALID_OFFSET = ^uint64(0)
 )
 
 func BrokerClusterNameSet(name string) {
 	CLUSTER_NAME = name
+
+	KEY_COMMON = "/" + CLUSTER_NAME + "/common"
+	KEY_PARTITION = "/" + CLUSTER_NAME + "/partition/"
+	KEY_BROKER = "/" + CLUSTER_NAME + "/broker/"
+	KEY_TOPIC = "/" + CLUSTER_NAME + "/topic/"
+	KEY_CONSUMER = "/" + CLUSTER_NAME + "/consumer/"
+	KEY_GROUP = "/" + CLUSTER_NAME + "/group/"
+	KEY_GROUPOFFSET = "/" + CLUSTER_NAME + "/groupoffset/"
+	KEY_GROUPOWNER = "/" + CLUSTER_NAME + "/groupowner/"
+	KEY_CONTROLLER = "/" + CLUSTER_NAME + "/controller"
+	KEY_REASSIGN = "/" + CLUSTER_NAME + "/reassign/"
+	KEY_DECOMMISSION = "/" + CLUSTER_NAME + "/decommission/"
 }
@@ -49,3 +49,12 @@ func TimeStamp() string {
 		tm.Hour(), tm.Minute(), tm.Second(),
 		tm.Nanosecond()/int(time.Millisecond))
 }
+
+func stringsHas(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}